@@ -1,3 +1,10 @@
 module pwfz
 
 go 1.24.6
+
+require (
+	golang.org/x/term v0.37.0
+	golang.org/x/text v0.31.0
+)
+
+require golang.org/x/sys v0.38.0 // indirect
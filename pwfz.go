@@ -1,7 +1,59 @@
 // pwfz.go
 //
 // Usage:
-//   PASSWORK_API_KEY=... pwfz [search query...]
+//   PASSWORK_API_KEY=... pwfz [flags] [search query...]
+//   PASSWORK_API_KEY=... pwfz delete [-yes] [flags] [search query...]
+//   PASSWORK_API_KEY=... pwfz add -vault V [-name N] [-login L] [-url U] < password
+//   PASSWORK_API_KEY=... pwfz import -in FILE -vault V [-yes | -dry-run]
+//   PASSWORK_API_KEY=... pwfz edit [-show-secrets] [flags] [search query...]
+//   PASSWORK_API_KEY=... pwfz history [flags] [search query...]
+//   PASSWORK_API_KEY=... pwfz benchmark [-runs N] [-concurrency N] [-json] [search query...]
+//   PASSWORK_API_KEY=... pwfz sync [flags]
+//   pwfz doctor [flags]
+//   pwfz schema    (JSON Schema of an entry, no network)
+//   pwfz completion bash|zsh|fish   (completion of recent queries)
+//
+// Any "@file" argument is replaced by the lines of that file, one argument
+// per line ("#" starts a comment line). Write "@@" for a literal "@"; nothing
+// after "--" is expanded.
+//
+// Flags:
+//   -folder NAME   only entries with a path segment containing NAME
+//   -depth N       only entries at most N path segments deep
+//   -vault V       only entries from vault V (name or ID)
+//   -tag T         only entries tagged T (repeatable; all must match)
+//   -tag-any       with several -tag, any one of them is enough
+//   -fields LIST   columns to show, e.g. name,login,url
+//   -stable        order entries by ID for reproducible output
+//   -group-by-vault  group entries under a header line per vault
+//   -v, -vv        verbose diagnostics on stderr (-vv adds HTTP headers)
+//   -q, -quiet     no progress output
+//   -strict        fail instead of warning on soft limits
+//   -reauth-on-empty  log in again and retry once if the search is empty
+//   -include-archived  also search archived/trashed entries
+//   -limit N       fetch at most N search results
+//   -insecure      skip TLS certificate verification (warns on every run)
+//   -profile NAME  use profile NAME from the config file
+//   -copy MODE     password (default), login, url, url-with-creds, dotenv,
+//                  masked, custom:NAME, or json-key:KEY
+//   -copy-field NAME  copy custom field NAME instead of the password
+//   -copy-nth N    with custom:NAME, copy item N of the field
+//   -copy-case C   lower, upper or none (default) for a copied login/url
+//   -check-strength  warn (never block) when the copied password looks weak
+//   -first         skip fzf and take the first result
+//   -max-matches N  with -first, fail when the search finds more than N
+//   -list          print the matching entries and exit (no fzf, no clipboard)
+//   -count         print the number of search hits and exit (nothing is fetched)
+//   -no-last       without a query, do not pre-fill fzf with the last query
+//   -json          print the selected entry (decoded password) as JSON
+//   -json-exclude F,...  with -json, leave out these fields (e.g. password,custom)
+//   -metrics-file PATH  write Prometheus textfile metrics for the run
+//   -output-fd N   write the value to file descriptor N instead of the clipboard
+//   -stdout        print the value to stdout instead of the clipboard
+//   -newline       with -stdout, end the value with a newline
+//   -multi         pick several entries, print "name<TAB>value" for each
+//   -query-from-clipboard  search for the current clipboard contents
+//   -copy-password-and-totp  copy the password, then the TOTP code on Enter
 //
 // Workflow:
 //   1. Login with /auth/login/{apiKey} -> token
@@ -11,28 +63,108 @@
 //   5. Copy cryptedPassword of selected entry to clipboard.
 //
 // Env:
-//   PASSWORK_BASE_URL   (required)
-//   PASSWORK_API_KEY    (required)
+//   PASSWORK_BASE_URL   (required; a bare host means https://HOST/api/v4; comma-separated for several)
+//   PASSWORK_API_KEY    (required; one key, or one per base URL)
+//   PWFZ_API_KEY_CMD    (optional; command printing the API key, used when
+//                        PASSWORK_API_KEY is unset, e.g. pass show ...)
+//   PWFZ_MASTER_PASSWORD (optional; for client-side encrypted entries,
+//                        prompted for on the terminal when unset)
+//   PWFZ_CONFIG         (optional; config file used when the two above are
+//                        unset, default ~/.config/pwfz/config.json)
+//   PWFZ_PROFILE        (optional; config file profile, like -profile; a profile
+//                        may also set CLIP_BIN, FZF_BIN, PWFZ_FZF_OPTS and
+//                        PWFZ_CLEAR_SECONDS where they are unset)
 //   FZF_BIN             (default: fzf)
+//   PWFZ_FZF_OPTS       (optional; extra fzf options, e.g. "--height=40% --border")
 //   CLIP_BIN            (optional; pbcopy/xclip/wl-copy autodetected)
+//   OPEN_BIN            (optional; browser command for ctrl-o, open/xdg-open detected)
+//   PASTE_BIN           (optional; pbpaste/xclip -o/wl-paste autodetected)
+//   PWFZ_OSC52          (optional; 1 = copy with an OSC 52 terminal escape, also
+//                        the fallback when no clipboard command is found)
+//   PWFZ_CLIP_SSH       (optional; user@host whose clipboard receives the value)
+//   PWFZ_CLIP_SSH_CMD   (default: pbcopy; clipboard command run on that host)
+//   PWFZ_PASTE_APP_CMD  (optional; shell command run after a successful copy)
+//   PWFZ_DOWNLOAD_DIR   (optional; where ctrl-a saves attachments, default .)
+//   PWFZ_HISTORY        (optional; 0 = do not remember queries)
+//   PWFZ_CACHE_TTL      (optional; reuse entry details (no secrets) this long, e.g. 5m)
+//   PWFZ_TOKEN_TTL      (optional; seconds to reuse a cached token, 0 = off)
+//   PWFZ_HTTP_TIMEOUT   (optional; per-request timeout, default 15s)
+//   PWFZ_TIMEOUT        (optional; bound on login+search+fetch, e.g. 1m)
+//   PWFZ_FZF_TIMEOUT    (optional; close an unattended fzf prompt after this long)
+//   PWFZ_RETRIES        (optional; attempts on dropped connections/502-504, default 3)
+//   PWFZ_RETRY_BUDGET   (optional; most retries in a whole run, default no cap)
+//   PWFZ_CONCURRENCY    (optional; parallel detail fetches, default 8)
+//   PWFZ_RATE           (optional; detail fetches per second, default unlimited)
+//   PWFZ_EXPIRY_WARN    (optional; warn this long before expiry, default 7d)
+//   PWFZ_CLEAR_SECONDS  (optional; clear the clipboard after N seconds,
+//                        default 45, 0 = never)
+//   PWFZ_CLIP_RESTORE   (optional; 1 = restore the previous clipboard afterwards)
+//   PWFZ_CLIP_RESTORE_AFTER  (optional; seconds before restoring, default 30)
+//   PWFZ_BELL           (optional; 1 = ring the terminal bell after a copy)
+//   PWFZ_BELL_CMD       (optional; sound command to run instead of the bell)
+//   PWFZ_FIELD_SEP      (default: newline; item separator for -copy-nth)
+//   PWFZ_MIN_STRENGTH   (default: 3; 0-4 threshold for -check-strength)
+//   PWFZ_HEADERS        (optional; "Name: value; Other: value" sent on every request)
+//   PWFZ_INSECURE       (optional; 1 = skip TLS certificate verification)
+//   HTTPS_PROXY, HTTP_PROXY, NO_PROXY  (optional; standard proxy settings)
+//   PWFZ_PIN_SHA256     (optional; base64 SPKI SHA-256 pin(s), comma-separated)
+//   NO_COLOR            (optional; any value turns off colors in the list)
+//   PWFZ_OUTPUT_CHARSET (default: utf-8; charset for fzf lines and stdout)
+//   PWFZ_CONFIRM_TAGS   (optional; comma-separated tags that need [y/N] before copy)
+//   PWFZ_READONLY       (optional; 1 disables every subcommand that writes)
+//   PWFZ_MAX_CLIP_BYTES (default: 1048576; 0 disables the size check)
 
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base32"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"maps"
+	"math"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
 )
 
 // -----------------------------------------------------------------------------
@@ -42,19 +174,28 @@ import (
 type Config struct {
 	BaseURL string
 	APIKey  string
+	Profile string      // -profile / PWFZ_PROFILE, "default" otherwise
+	Headers http.Header // extra headers from PWFZ_HEADERS, sent on every request
+	Pins    [][]byte    // SPKI SHA-256 pins from PWFZ_PIN_SHA256
+
+	// Insecure skips TLS certificate verification (-insecure or
+	// PWFZ_INSECURE=1). Pins, if any, are still checked.
+	Insecure bool
 }
 
 type loginResponse struct {
 	Status string `json:"status"`
 	Data   struct {
-		Token string `json:"token"`
+		Token          string `json:"token"`
+		TokenExpiredAt int64  `json:"tokenExpiredAt"`
 	} `json:"data"`
 }
 
-// /passwords/search response (short items)
+// /passwords/search response (short items). Data is usually an array, but
+// some server versions return an object keyed by ID; see decodeSearchHits.
 type passwordSearchResponse struct {
-	Status string              `json:"status"`
-	Data   []passwordSearchHit `json:"data"`
+	Status string          `json:"status"`
+	Data   json.RawMessage `json:"data"`
 }
 
 type passwordSearchHit struct {
@@ -80,6 +221,19 @@ type passwordDetail struct {
 	Path            []pathSegment    `json:"path"`
 	Custom          []customField    `json:"custom"`
 	Attachments     []attachmentInfo `json:"attachments"`
+	Archived        bool             `json:"isArchived"`
+	Expires         expiryDate       `json:"expirationDate"`
+
+	// lazy marks a placeholder built from a search hit whose detail fetch
+	// failed; the full entry is loaded once it is selected.
+	lazy bool
+	// cached marks an entry from the detail cache, which has no secrets;
+	// it is fetched again once it is selected.
+	cached bool
+	// src is the instance the entry came from (main search only).
+	src *instance
+	// vault is the vault name from the server's vault list; see nameVaults.
+	vault string
 }
 
 type pathSegment struct {
@@ -105,47 +259,435 @@ type attachmentInfo struct {
 // HTTP helpers
 // -----------------------------------------------------------------------------
 
-func newHTTPClient() *http.Client {
+// newHTTPClient builds the client for cfg. Proxies come from HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY.
+func newHTTPClient(cfg Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.TLSClientConfig = &tls.Config{}
+	if len(cfg.Pins) > 0 {
+		transport.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPin(cs, cfg.Pins)
+		}
+	}
+	if cfg.Insecure {
+		fmt.Fprintf(os.Stderr, "WARNING: TLS certificate verification is OFF for %s (-insecure / PWFZ_INSECURE). Anyone on the network path can read your API key and passwords.\n", cfg.BaseURL)
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
 	return &http.Client{
-		Timeout: 15 * time.Second,
+		Timeout:   envDuration("PWFZ_HTTP_TIMEOUT", 15*time.Second),
+		Transport: loggingTransport{transport},
+	}
+}
+
+// loggingTransport logs every request with -v, and its headers with -vv.
+// The API key (part of the login path) and header values are redacted.
+type loggingTransport struct {
+	next http.RoundTripper
+}
+
+func (t loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if logLevel < 1 {
+		return t.next.RoundTrip(req)
+	}
+	start := time.Now()
+	tracef("> %s %s %s", req.Method, redactURL(req.URL), redactHeaders(req.Header))
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		debugf("%s %s: %v (%s)", req.Method, redactURL(req.URL), err, time.Since(start).Round(time.Millisecond))
+		return nil, err
+	}
+	debugf("%s %s: %d (%s)", req.Method, redactURL(req.URL), resp.StatusCode, time.Since(start).Round(time.Millisecond))
+	tracef("< %s", redactHeaders(resp.Header))
+	return resp, nil
+}
+
+// redactURL drops the query string and the API key from the login path.
+func redactURL(u *neturl.URL) string {
+	r := *u
+	r.User, r.RawQuery = nil, ""
+	out := r.String()
+	if i := strings.Index(out, "/auth/login/"); i >= 0 {
+		out = out[:i] + "/auth/login/<redacted>"
+	}
+	return out
+}
+
+// safeHeaders are shown in full by -vv; every other value is redacted,
+// which covers Passwork-Auth and anything set through PWFZ_HEADERS.
+var safeHeaders = map[string]bool{
+	"Accept":         true,
+	"Content-Length": true,
+	"Content-Type":   true,
+	"Date":           true,
+	"Retry-After":    true,
+	"User-Agent":     true,
+}
+
+func redactHeaders(h http.Header) string {
+	names := slices.Sorted(maps.Keys(h))
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		val := "<redacted>"
+		if safeHeaders[name] {
+			val = strings.Join(h[name], ", ")
+		}
+		parts = append(parts, name+": "+val)
+	}
+	return "[" + strings.Join(parts, "; ") + "]"
+}
+
+// errPinMismatch marks a connection rejected by PWFZ_PIN_SHA256.
+var errPinMismatch = errors.New("certificate pinning")
+
+// verifyPin checks the leaf certificate's SubjectPublicKeyInfo against the
+// configured SHA-256 pins. It runs in addition to normal chain verification.
+func verifyPin(cs tls.ConnectionState, pins [][]byte) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("%w: server sent no certificate", errPinMismatch)
+	}
+	sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if subtle.ConstantTimeCompare(sum[:], pin) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s presented key sha256/%s, which matches no PWFZ_PIN_SHA256 pin",
+		errPinMismatch, cs.ServerName, base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// parsePins parses PWFZ_PIN_SHA256: one or more comma-separated base64
+// SHA-256 digests of a SubjectPublicKeyInfo.
+func parsePins(spec string) ([][]byte, error) {
+	var pins [][]byte
+	for _, p := range strings.Split(spec, ",") {
+		p = strings.TrimPrefix(strings.TrimSpace(p), "sha256/")
+		if p == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(p)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("PWFZ_PIN_SHA256: %q is not a base64 SHA-256 digest", p)
+		}
+		pins = append(pins, b)
+	}
+	return pins, nil
+}
+
+// retryable reports whether a transport error is worth another attempt:
+// timeouts, refused or reset connections, and connections closed mid-reply.
+// Certificate, TLS and pin failures will not go away by retrying, so they
+// fail right away, as does anything not recognised.
+func retryable(err error) bool {
+	var (
+		unknownCA x509.UnknownAuthorityError
+		invalid   x509.CertificateInvalidError
+		hostname  x509.HostnameError
+		verify    *tls.CertificateVerificationError
+		header    tls.RecordHeaderError
+		netErr    net.Error
+	)
+	switch {
+	case errors.Is(err, errPinMismatch),
+		errors.As(err, &unknownCA), errors.As(err, &invalid), errors.As(err, &hostname),
+		errors.As(err, &verify), errors.As(err, &header):
+		return false
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryBudget caps the retries of a whole run, across every phase and every
+// parallel detail fetch, so a flaky server cannot multiply PWFZ_RETRIES by
+// hundreds of requests. A negative limit means no cap.
+type retryBudget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// take uses up one retry, reporting false (and warning the first time) once
+// the budget is spent.
+func (b *retryBudget) take() bool {
+	if b.limit < 0 {
+		return true
+	}
+	n := b.used.Add(1)
+	if n == b.limit+1 {
+		warnf("PWFZ_RETRY_BUDGET of %d retries used up; further errors fail right away", b.limit)
+	}
+	return n <= b.limit
+}
+
+// retries is the run's PWFZ_RETRY_BUDGET (unset = no cap), read on first
+// use. Tests replace it.
+var retries = sync.OnceValue(func() *retryBudget {
+	return &retryBudget{limit: int64(envInt("PWFZ_RETRY_BUDGET", -1))}
+})
+
+// doWithRetry sends req, retrying the transport errors retryable accepts
+// and 502/503/504 responses with exponential backoff (200ms, 400ms, 800ms,
+// ...). 4xx responses are never retried. PWFZ_RETRIES sets the number of
+// attempts (default 3), each retry is taken from the run's retries budget,
+// and the wait between them respects ctx.
+func doWithRetry(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, error) {
+	attempts := max(envInt("PWFZ_RETRIES", 3), 1)
+	delay := 200 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Do(req)
+		retry := err != nil && ctx.Err() == nil && retryable(err)
+		if err == nil {
+			switch resp.StatusCode {
+			case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+				retry = true
+			}
+		}
+		if !retry || attempt >= attempts || !retries().take() {
+			return resp, err
+		}
+		if err != nil {
+			debugf("attempt %d/%d failed: %v; retrying in %s", attempt, attempts, err, delay)
+		} else {
+			debugf("attempt %d/%d: status=%d; retrying in %s", attempt, attempts, resp.StatusCode, delay)
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+// setCommonHeaders applies the auth token (when there is one) and any extra
+// PWFZ_HEADERS to an outgoing request.
+func setCommonHeaders(req *http.Request, cfg Config, token string) {
+	for name, values := range cfg.Headers {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+	if token != "" {
+		req.Header.Set("Passwork-Auth", token)
 	}
 }
 
+// errUnauthorized marks a 401 from an authenticated request; callers log in
+// again and retry once (the cached token may have been revoked early).
+var errUnauthorized = errors.New("unauthorized (token expired or revoked)")
+
+// APIError is a non-success HTTP answer from the Passwork API. Code and
+// Message come from the JSON error body when there is one; otherwise
+// Message holds the raw body. A 401 also matches errUnauthorized.
+type APIError struct {
+	Op      string // what was attempted, e.g. "search" or "get password ID"
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s failed: status=%d", e.Op, e.Status)
+	if e.Status == http.StatusUnauthorized && e.Op != "login" {
+		msg += ": " + errUnauthorized.Error()
+	}
+	if e.Code != "" {
+		msg += " code=" + e.Code
+	}
+	if e.Message != "" {
+		msg += " message=" + e.Message
+	}
+	return msg
+}
+
+func (e *APIError) Is(target error) bool {
+	return target == errUnauthorized && e.Status == http.StatusUnauthorized
+}
+
+// newAPIError reads the error body of resp for op.
+func newAPIError(op string, resp *http.Response) *APIError {
+	e := &APIError{Op: op, Status: resp.StatusCode}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var eb struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &eb) == nil && (eb.Code != "" || eb.Message != "") {
+		e.Code, e.Message = eb.Code, eb.Message
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	return e
+}
+
+// login returns a session token, reusing a cached one while it is valid and
+// logging in only on a cache miss.
 func login(ctx context.Context, cfg Config, client *http.Client) (string, error) {
+	if token, ok := loadCachedToken(cfg); ok {
+		debugf("using cached token")
+		return token, nil
+	}
+	return relogin(ctx, cfg, client)
+}
+
+// relogin always logs in, refreshing the token cache.
+func relogin(ctx context.Context, cfg Config, client *http.Client) (string, error) {
+	token, expires, err := requestToken(ctx, cfg, client)
+	if err != nil {
+		return "", err
+	}
+	saveCachedToken(cfg, token, expires)
+	return token, nil
+}
+
+// requestToken exchanges the API key for a session token and its expiry.
+func requestToken(ctx context.Context, cfg Config, client *http.Client) (string, time.Time, error) {
 	if cfg.APIKey == "" {
-		return "", errors.New("PASSWORK_API_KEY is not set")
+		return "", time.Time{}, errors.New("PASSWORK_API_KEY is not set")
 	}
 	url := strings.TrimRight(cfg.BaseURL, "/") + "/auth/login/" + cfg.APIKey
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
-	resp, err := client.Do(req)
+	setCommonHeaders(req, cfg, "")
+
+	resp, err := doWithRetry(ctx, client, req)
 	if err != nil {
-		return "", err
+		// The error carries the URL, and with it the API key.
+		var uerr *neturl.Error
+		if errors.As(err, &uerr) {
+			uerr.URL = redactURL(req.URL)
+		}
+		return "", time.Time{}, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		return "", fmt.Errorf("login failed: status=%d body=%s", resp.StatusCode, string(body))
+		return "", time.Time{}, newAPIError("login", resp)
 	}
 
 	var lr loginResponse
 	if err := json.NewDecoder(resp.Body).Decode(&lr); err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
 	if lr.Status != "success" || lr.Data.Token == "" {
-		return "", fmt.Errorf("login failed: status=%s token empty", lr.Status)
+		return "", time.Time{}, fmt.Errorf("login failed: status=%s token empty", lr.Status)
+	}
+	var expires time.Time
+	if lr.Data.TokenExpiredAt > 0 {
+		expires = time.Unix(lr.Data.TokenExpiredAt, 0)
 	}
-	return lr.Data.Token, nil
+	return lr.Data.Token, expires, nil
 }
 
+// searchPageSize is how many hits searchPasswords asks for per request.
+const searchPageSize = 100
+
+// searchPasswords collects all search hits page by page, stopping at a short
+// page, at -limit, or when a page brings nothing new (servers that ignore
+// offset/limit return everything every time).
 func searchPasswords(ctx context.Context, cfg Config, client *http.Client, token, query string) ([]passwordSearchHit, error) {
+	var all []passwordSearchHit
+	for offset := 0; ; offset += searchPageSize {
+		page, err := searchPage(ctx, cfg, client, token, query, offset, searchPageSize)
+		if err != nil {
+			return nil, err
+		}
+		before := len(all)
+		all = mergeHits(all, page)
+		added := len(all) - before
+		if len(page) < searchPageSize || added == 0 || (searchLimit > 0 && len(all) >= searchLimit) {
+			break
+		}
+		debugf("search: fetched %d hits so far, requesting the next page", len(all))
+	}
+	return capHits(all), nil
+}
+
+// browseAll serves an empty query. Some servers answer an empty search
+// with nothing, so it lists every vault's entries instead, and only falls
+// back to the empty search when the listing fails.
+func browseAll(ctx context.Context, cfg Config, client *http.Client, token, query string) ([]passwordSearchHit, error) {
+	hits, err := listAllPasswords(ctx, cfg, client, token)
+	if err == nil || errors.Is(err, errUnauthorized) {
+		return hits, err
+	}
+	debugf("listing all entries failed, using an empty search instead: %v", err)
+	return searchPasswords(ctx, cfg, client, token, query)
+}
+
+// listAllPasswords lists the entries of every vault the API key can see.
+func listAllPasswords(ctx context.Context, cfg Config, client *http.Client, token string) ([]passwordSearchHit, error) {
+	vaults, err := cachedVaults(ctx, cfg, client, token)
+	if err != nil {
+		return nil, err
+	}
+	var all []passwordSearchHit
+	for _, v := range vaults {
+		hits, err := listVaultPasswords(ctx, cfg, client, token, v.ID)
+		if err != nil {
+			return nil, fmt.Errorf("vault %q: %w", v.Name, err)
+		}
+		all = mergeHits(all, hits)
+		if searchLimit > 0 && len(all) >= searchLimit {
+			break
+		}
+	}
+	debugf("listed %d entries in %d vaults", len(all), len(vaults))
+	return capHits(all), nil
+}
+
+// listVaultPasswords returns the entries of one vault from
+// GET /vaults/{id}/passwords.
+func listVaultPasswords(ctx context.Context, cfg Config, client *http.Client, token, vaultID string) ([]passwordSearchHit, error) {
+	url := strings.TrimRight(cfg.BaseURL, "/") + "/vaults/" + vaultID + "/passwords"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	setCommonHeaders(req, cfg, token)
+
+	resp, err := doWithRetry(ctx, client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError("list passwords", resp)
+	}
+
+	var sr passwordSearchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		return nil, err
+	}
+	if sr.Status != "success" {
+		return nil, fmt.Errorf("list passwords failed: status=%s", sr.Status)
+	}
+	return decodeSearchHits(sr.Data)
+}
+
+func searchPage(ctx context.Context, cfg Config, client *http.Client, token, query string, offset, limit int) ([]passwordSearchHit, error) {
 	url := strings.TrimRight(cfg.BaseURL, "/") + "/passwords/search"
 
-	reqBody := map[string]string{"query": query}
+	reqBody := map[string]any{"query": query, "offset": offset, "limit": limit}
+	if includeArchived {
+		reqBody["includeArchived"] = true
+	}
 	buf, err := json.Marshal(reqBody)
 	if err != nil {
 		return nil, err
@@ -156,17 +698,19 @@ func searchPasswords(ctx context.Context, cfg Config, client *http.Client, token
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Passwork-Auth", token)
+	setCommonHeaders(req, cfg, token)
 
-	resp, err := client.Do(req)
+	resp, err := doWithRetry(ctx, client, req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if includeArchived && (resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnprocessableEntity) {
+		return nil, fmt.Errorf("search failed: status=%d (this server does not seem to support -include-archived)", resp.StatusCode)
+	}
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		return nil, fmt.Errorf("search failed: status=%d body=%s", resp.StatusCode, string(body))
+		return nil, newAPIError("search", resp)
 	}
 
 	var sr passwordSearchResponse
@@ -176,7 +720,49 @@ func searchPasswords(ctx context.Context, cfg Config, client *http.Client, token
 	if sr.Status != "success" {
 		return nil, fmt.Errorf("search failed: status=%s", sr.Status)
 	}
-	return sr.Data, nil
+	return decodeSearchHits(sr.Data)
+}
+
+// decodeSearchHits accepts both shapes of the search "data" field: an array
+// of hits, or an object mapping ID to hit. Object order is preserved.
+func decodeSearchHits(raw json.RawMessage) ([]passwordSearchHit, error) {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+		return nil, nil
+	}
+
+	if trimmed[0] == '[' {
+		var hits []passwordSearchHit
+		if err := json.Unmarshal(trimmed, &hits); err != nil {
+			return nil, fmt.Errorf("decode search results: %w", err)
+		}
+		return hits, nil
+	}
+
+	if trimmed[0] != '{' {
+		return nil, fmt.Errorf("decode search results: unexpected data shape %.20q", trimmed)
+	}
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	if _, err := dec.Token(); err != nil { // opening '{'
+		return nil, fmt.Errorf("decode search results: %w", err)
+	}
+	var hits []passwordSearchHit
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("decode search results: %w", err)
+		}
+		key, _ := tok.(string)
+		var h passwordSearchHit
+		if err := dec.Decode(&h); err != nil {
+			return nil, fmt.Errorf("decode search result %s: %w", key, err)
+		}
+		if h.ID == "" {
+			h.ID = key
+		}
+		hits = append(hits, h)
+	}
+	return hits, nil
 }
 
 func getPassword(ctx context.Context, cfg Config, client *http.Client, token, id string) (passwordDetail, error) {
@@ -186,17 +772,16 @@ func getPassword(ctx context.Context, cfg Config, client *http.Client, token, id
 	if err != nil {
 		return passwordDetail{}, err
 	}
-	req.Header.Set("Passwork-Auth", token)
+	setCommonHeaders(req, cfg, token)
 
-	resp, err := client.Do(req)
+	resp, err := doWithRetry(ctx, client, req)
 	if err != nil {
 		return passwordDetail{}, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		return passwordDetail{}, fmt.Errorf("get password %s failed: status=%d body=%s", id, resp.StatusCode, string(body))
+		return passwordDetail{}, newAPIError("get password "+id, resp)
 	}
 
 	var gr passwordGetResponse
@@ -209,243 +794,5682 @@ func getPassword(ctx context.Context, cfg Config, client *http.Client, token, id
 	return gr.Data, nil
 }
 
-// -----------------------------------------------------------------------------
-// fzf & clipboard helpers
-// -----------------------------------------------------------------------------
+type apiStatusResponse struct {
+	Status string `json:"status"`
+}
 
-func runFzf(lines []string) (string, error) {
-	fzf := os.Getenv("FZF_BIN")
-	if fzf == "" {
-		fzf = "fzf"
-	}
+// /passwords/{id}/attachments/{attId} response
+type attachmentResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		Name string `json:"name"`
+		Data string `json:"data"`
+	} `json:"data"`
+}
 
-	cmd := exec.Command(fzf, "--with-nth=2..", "--height=15", "--style=minimal", "--color=dark", "--delimiter=\t")
-	cmd.Stdin = strings.NewReader(strings.Join(lines, "\n"))
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = os.Stderr
+// getAttachment downloads one attachment and returns its content and file
+// name. The content arrives base64-encoded; attachments encrypted with a
+// client-side key cannot be decoded here and fail with an error.
+func getAttachment(ctx context.Context, cfg Config, client *http.Client, token, passwordID, attID string) ([]byte, string, error) {
+	url := strings.TrimRight(cfg.BaseURL, "/") + "/passwords/" + passwordID + "/attachments/" + attID
 
-	if err := cmd.Run(); err != nil {
-		return "", err
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
 	}
-	return strings.TrimSpace(out.String()), nil
-}
+	setCommonHeaders(req, cfg, token)
 
-func detectClipboardCommand() []string {
-	if bin := os.Getenv("CLIP_BIN"); bin != "" {
-		return []string{bin}
+	resp, err := doWithRetry(ctx, client, req)
+	if err != nil {
+		return nil, "", err
 	}
-	switch runtime.GOOS {
-	case "darwin":
-		return []string{"pbcopy"}
-	case "linux":
-		if _, err := exec.LookPath("wl-copy"); err == nil {
-			return []string{"wl-copy"}
-		}
-		if _, err := exec.LookPath("xclip"); err == nil {
-			return []string{"xclip", "-selection", "clipboard"}
-		}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", newAPIError("get attachment "+attID, resp)
 	}
-	return nil
-}
 
-func copyToClipboard(text string) error {
-	cmdArgs := detectClipboardCommand()
-	if cmdArgs == nil {
-		return errors.New("no clipboard command found (set CLIP_BIN or install pbcopy/xclip/wl-copy)")
+	var ar attachmentResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ar); err != nil {
+		return nil, "", err
 	}
-	cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
-	cmd.Stdin = strings.NewReader(text)
-	return cmd.Run()
+	if ar.Status != "success" {
+		return nil, "", fmt.Errorf("get attachment %s failed: status=%s", attID, ar.Status)
+	}
+	data, err := base64.StdEncoding.DecodeString(ar.Data.Data)
+	if err != nil {
+		return nil, "", fmt.Errorf("attachment %s is not base64 (client-side encrypted attachments are not supported): %w", attID, err)
+	}
+	return data, ar.Data.Name, nil
 }
 
-// -----------------------------------------------------------------------------
-// formatting helpers
-// -----------------------------------------------------------------------------
-
-func orDash(s string) string {
-	if strings.TrimSpace(s) == "" {
-		return "-"
-	}
-	return s
+// /vaults response
+type vaultListResponse struct {
+	Status string      `json:"status"`
+	Data   []vaultInfo `json:"data"`
 }
 
-func orEmpty(s string) string {
-	if strings.TrimSpace(s) == "" {
-		return ""
-	}
-	return s
+type vaultInfo struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
 }
 
-func decodeB64OrRaw(s string) string {
-	b, err := base64.StdEncoding.DecodeString(s)
+func listVaults(ctx context.Context, cfg Config, client *http.Client, token string) ([]vaultInfo, error) {
+	url := strings.TrimRight(cfg.BaseURL, "/") + "/vaults"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return s
+		return nil, err
 	}
-	return string(b)
-}
+	setCommonHeaders(req, cfg, token)
 
-func formatDescription(custom []customField) string {
-	if len(custom) == 0 {
-		return ""
-	}
-	parts := make([]string, 0, len(custom))
-	for _, c := range custom {
-		name := orEmpty(decodeB64OrRaw(c.Name))
-		val := orEmpty(decodeB64OrRaw(c.Value))
-		if name == "" && val == "" {
-			continue
-		}
-		if name == "" {
-			parts = append(parts, val)
-		} else if val == "" {
-			parts = append(parts, name)
-		} else {
-			parts = append(parts, fmt.Sprintf("%s=%s", name, val))
-		}
+	resp, err := doWithRetry(ctx, client, req)
+	if err != nil {
+		return nil, err
 	}
-	return strings.Join(parts, "; ")
-}
+	defer resp.Body.Close()
 
-func formatPath(path []pathSegment) string {
-	if len(path) == 0 {
-		return ""
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError("list vaults", resp)
 	}
-	// sort by order just in case
-	sort.Slice(path, func(i, j int) bool {
-		return path[i].Order < path[j].Order
-	})
-	names := make([]string, 0, len(path))
-	for _, p := range path {
-		if orEmpty(p.Name) != "" {
-			names = append(names, p.Name)
-		}
+
+	var vr vaultListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&vr); err != nil {
+		return nil, err
 	}
-	if len(names) == 0 {
-		return ""
+	if vr.Status != "success" {
+		return nil, fmt.Errorf("list vaults failed: status=%s", vr.Status)
 	}
-	return strings.Join(names, " / ")
+	return vr.Data, nil
+}
+
+// vaultLists caches each account's vault list for the rest of the run,
+// keyed by accountHash: browsing, -vault and vault names all need it.
+var vaultLists = struct {
+	sync.Mutex
+	m map[string][]vaultInfo
+}{m: map[string][]vaultInfo{}}
+
+// cachedVaults is listVaults, asking the server only once per run.
+func cachedVaults(ctx context.Context, cfg Config, client *http.Client, token string) ([]vaultInfo, error) {
+	key := accountHash(cfg)
+	vaultLists.Lock()
+	defer vaultLists.Unlock()
+	if vaults, ok := vaultLists.m[key]; ok {
+		return vaults, nil
+	}
+	vaults, err := listVaults(ctx, cfg, client, token)
+	if err != nil {
+		return nil, err
+	}
+	vaultLists.m[key] = vaults
+	return vaults, nil
+}
+
+// passwordInput is the body of POST /passwords.
+type passwordInput struct {
+	VaultID         string `json:"vaultId"`
+	Name            string `json:"name"`
+	Login           string `json:"login,omitempty"`
+	URL             string `json:"url,omitempty"`
+	Description     string `json:"description,omitempty"`
+	CryptedPassword string `json:"cryptedPassword"` // base64 of the password
+}
+
+type createPasswordResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
+
+// createPassword creates an entry and returns its ID. It is not retried,
+// so a gateway error cannot create the entry twice.
+func createPassword(ctx context.Context, cfg Config, client *http.Client, token string, in passwordInput) (string, error) {
+	url := strings.TrimRight(cfg.BaseURL, "/") + "/passwords"
+
+	body, err := json.Marshal(in)
+	if err != nil {
+		return "", err
+	}
+	defer clear(body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	setCommonHeaders(req, cfg, token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", newAPIError("create password", resp)
+	}
+
+	var cr createPasswordResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cr); err != nil {
+		return "", err
+	}
+	if cr.Status != "success" || cr.Data.ID == "" {
+		return "", fmt.Errorf("create password failed: status=%s", cr.Status)
+	}
+	return cr.Data.ID, nil
+}
+
+func deletePassword(ctx context.Context, cfg Config, client *http.Client, token, id string) error {
+	url := strings.TrimRight(cfg.BaseURL, "/") + "/passwords/" + id
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
+	if err != nil {
+		return err
+	}
+	setCommonHeaders(req, cfg, token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return newAPIError("delete password "+id, resp)
+	}
+
+	var sr apiStatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if sr.Status != "" && sr.Status != "success" {
+		return fmt.Errorf("delete password %s failed: status=%s", id, sr.Status)
+	}
+	return nil
+}
+
+// updatePassword sends patch to PATCH /passwords/{id}. The patch holds only
+// the fields that change, already in the API's encoding.
+func updatePassword(ctx context.Context, cfg Config, client *http.Client, token, id string, patch map[string]any) error {
+	url := strings.TrimRight(cfg.BaseURL, "/") + "/passwords/" + id
+
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	defer clear(body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	setCommonHeaders(req, cfg, token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return newAPIError("update password "+id, resp)
+	}
+
+	var sr apiStatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if sr.Status != "" && sr.Status != "success" {
+		return fmt.Errorf("update password %s failed: status=%s", id, sr.Status)
+	}
+	return nil
+}
+
+// /passwords/{id}/history response
+type passwordHistoryResponse struct {
+	Status string         `json:"status"`
+	Data   []historyEvent `json:"data"`
+}
+
+type historyEvent struct {
+	Action   string `json:"action"`
+	User     string `json:"user"`
+	UserName string `json:"userName"`
+	Date     string `json:"date"`
+	Time     string `json:"time"`
+}
+
+func (e historyEvent) who() string {
+	if e.UserName != "" {
+		return e.UserName
+	}
+	return e.User
+}
+
+func (e historyEvent) when() string {
+	if e.Date != "" {
+		return e.Date
+	}
+	return e.Time
+}
+
+var errHistoryUnsupported = errors.New("entry history is not available on this server")
+
+func getPasswordHistory(ctx context.Context, cfg Config, client *http.Client, token, id string) ([]historyEvent, error) {
+	url := strings.TrimRight(cfg.BaseURL, "/") + "/passwords/" + id + "/history"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	setCommonHeaders(req, cfg, token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, errHistoryUnsupported
+	default:
+		return nil, newAPIError("get history "+id, resp)
+	}
+
+	var hr passwordHistoryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&hr); err != nil {
+		return nil, err
+	}
+	if hr.Status != "success" {
+		return nil, fmt.Errorf("get history %s failed: status=%s", id, hr.Status)
+	}
+	return hr.Data, nil
+}
+
+// -----------------------------------------------------------------------------
+// fzf & clipboard helpers
+// -----------------------------------------------------------------------------
+
+// resolveFzfBin locates the fzf binary (FZF_BIN or "fzf" on $PATH) and
+// explains what is wrong with it when it cannot be run.
+func resolveFzfBin() (string, error) {
+	fzf := strings.TrimSpace(os.Getenv("FZF_BIN"))
+	fromEnv := fzf != ""
+	if !fromEnv {
+		fzf = "fzf"
+	}
+
+	path, err := exec.LookPath(fzf)
+	if err == nil {
+		return path, nil
+	}
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		return "", fmt.Errorf("FZF_BIN=%s exists but is not executable (try chmod +x %s)", fzf, fzf)
+	case fromEnv:
+		return "", fmt.Errorf("FZF_BIN=%s not found (point it at the fzf binary or unset it to search $PATH)", fzf)
+	default:
+		return "", errNoFzf
+	}
+}
+
+// errNoFzf means fzf is simply not installed, as opposed to a broken
+// FZF_BIN; only then does chooseSelector fall back to the plain prompt.
+var errNoFzf = errors.New("fzf not found in $PATH (install fzf or set FZF_BIN)")
+
+// selector shows tab-separated lines, whose first field is a hidden key,
+// and returns the chosen lines: one, or several when extra holds --multi.
+// key is the --expect key that accepted them, empty for Enter; selected is
+// empty when the user cancelled.
+type selector interface {
+	Select(lines []string, header string, extra []string, expect ...string) (key string, selected []string, err error)
+}
+
+// chooseSelector returns fzf, or plainSelector when fzf is not installed.
+var chooseSelector = sync.OnceValues(func() (selector, error) {
+	bin, err := resolveFzfBin()
+	if errors.Is(err, errNoFzf) {
+		debugf("fzf not found, using the numbered prompt")
+		return plainSelector{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	opts, err := splitWords(os.Getenv("PWFZ_FZF_OPTS"))
+	if err != nil {
+		return nil, fmt.Errorf("PWFZ_FZF_OPTS: %w", err)
+	}
+	return fzfSelector{bin: bin, opts: opts}, nil
+})
+
+// selectLine runs the selector picked by chooseSelector.
+func selectLine(lines []string, header string, extra []string, expect ...string) (key string, selected []string, err error) {
+	sel, err := chooseSelector()
+	if err != nil {
+		return "", nil, err
+	}
+	return sel.Select(lines, header, extra, expect...)
+}
+
+type fzfSelector struct {
+	bin  string
+	opts []string // PWFZ_FZF_OPTS
+}
+
+// splitWords splits s into words like a POSIX shell would, honouring
+// single and double quotes and backslash escapes, for PWFZ_FZF_OPTS.
+func splitWords(s string) ([]string, error) {
+	var words []string
+	var w strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			w.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				w.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inWord = true, true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				w.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, w.String())
+				w.Reset()
+				inWord = false
+			}
+		default:
+			w.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or trailing backslash")
+	}
+	if inWord {
+		words = append(words, w.String())
+	}
+	return words, nil
+}
+
+func (f fzfSelector) Select(lines []string, header string, extra []string, expect ...string) (key string, selected []string, err error) {
+	args := []string{"--height=15", "--style=minimal", "--color=dark", "--ansi"}
+	if header != "" {
+		args = append(args, "--header="+encodeOutput(header))
+	}
+	args = append(args, extra...)
+	// fzf lets the last occurrence of an option win, so PWFZ_FZF_OPTS can
+	// override the look, but not the fields the hidden ID column relies on.
+	args = append(args, f.opts...)
+	args = append(args, "--with-nth=2..", "--delimiter=\t")
+	if len(expect) > 0 {
+		args = append(args, "--expect="+strings.Join(expect, ","))
+	}
+	// PWFZ_FZF_TIMEOUT stops a prompt left unattended. fzf gets SIGTERM
+	// first so it can restore the terminal.
+	ctx := context.Background()
+	limit := envDuration("PWFZ_FZF_TIMEOUT", 0)
+	if limit > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limit)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, f.bin, args...)
+	if runtime.GOOS != "windows" {
+		cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+		cmd.WaitDelay = 2 * time.Second
+	}
+	cmd.Stdin = strings.NewReader(encodeOutput(strings.Join(lines, "\n")))
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", nil, &exitError{code: exitNetwork, err: fmt.Errorf("selection timed out after %s (PWFZ_FZF_TIMEOUT)", limit)}
+		}
+		// fzf exits 1 when nothing matched and 130 on Esc or ctrl-c;
+		// both just mean nothing was selected.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			switch exitErr.ExitCode() {
+			case 1, 130:
+				debugf("fzf exited with status %d: nothing selected", exitErr.ExitCode())
+				return "", nil, nil
+			}
+		}
+		return "", nil, fmt.Errorf("fzf error: %w", err)
+	}
+	// With --expect, fzf prints the key that accepted the selection (empty
+	// for Enter) on a line of its own before the selection, which is one
+	// line per chosen entry.
+	res := out.String()
+	if len(expect) > 0 {
+		key, res, _ = strings.Cut(res, "\n")
+	}
+	for line := range strings.Lines(res) {
+		if line = strings.TrimSpace(line); line != "" {
+			selected = append(selected, line)
+		}
+	}
+	return strings.TrimSpace(key), selected, nil
+}
+
+// plainSelector is a numbered prompt on stderr for machines without fzf.
+// It shows the same columns as fzf; an --expect key is given by typing it
+// after the number, e.g. "2 ctrl-t", and with --multi several numbers may
+// be given. Other fzf arguments are ignored.
+type plainSelector struct{}
+
+func (plainSelector) Select(lines []string, header string, extra []string, expect ...string) (key string, selected []string, err error) {
+	multi := slices.Contains(extra, "--multi")
+	if header != "" {
+		fmt.Fprintln(os.Stderr, encodeOutput(header))
+	}
+	var choices []string
+	for _, line := range lines {
+		id, display, _ := strings.Cut(line, "\t")
+		if id == groupHeaderID {
+			fmt.Fprintln(os.Stderr, encodeOutput(stripANSI(display)))
+			continue
+		}
+		choices = append(choices, line)
+		fmt.Fprintf(os.Stderr, "%3d) %s\n", len(choices), encodeOutput(display))
+	}
+	if len(choices) == 0 {
+		return "", nil, nil
+	}
+
+	prompt := fmt.Sprintf("pick 1-%d", len(choices))
+	if multi {
+		prompt = fmt.Sprintf("pick one or more of 1-%d", len(choices))
+	}
+	if len(expect) > 0 {
+		prompt += ", optionally followed by " + strings.Join(expect, ", ")
+	}
+	in := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Fprintf(os.Stderr, "%s (empty to cancel): ", prompt)
+		answer, err := readLine(in)
+		if errors.Is(err, io.EOF) {
+			fmt.Fprintln(os.Stderr)
+			return "", nil, nil
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		fields := strings.Fields(strings.ReplaceAll(answer, ",", " "))
+		if len(fields) == 0 {
+			return "", nil, nil
+		}
+		key = ""
+		if f := fields[len(fields)-1]; slices.Contains(expect, f) {
+			key, fields = f, fields[:len(fields)-1]
+		}
+		picked, ok := pickNumbers(fields, len(choices))
+		switch {
+		case !ok:
+			fmt.Fprintf(os.Stderr, "not a number between 1 and %d, or an unknown key: %s\n", len(choices), answer)
+		case len(picked) > 1 && !multi:
+			fmt.Fprintln(os.Stderr, "pick only one entry")
+		default:
+			selected = nil
+			for _, n := range picked {
+				selected = append(selected, choices[n-1])
+			}
+			return key, selected, nil
+		}
+	}
+}
+
+// pickNumbers parses the entry numbers typed at the plain prompt, each
+// between 1 and count, dropping repeats.
+func pickNumbers(fields []string, count int) ([]int, bool) {
+	if len(fields) == 0 {
+		return nil, false
+	}
+	var picked []int
+	for _, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 1 || n > count {
+			return nil, false
+		}
+		if !slices.Contains(picked, n) {
+			picked = append(picked, n)
+		}
+	}
+	return picked, true
+}
+
+// stripANSI removes the SGR escapes fzf would render (see --ansi).
+func stripANSI(s string) string {
+	return ansiEscape.ReplaceAllString(s, "")
+}
+
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+func detectClipboardCommand() []string {
+	if bin := os.Getenv("CLIP_BIN"); bin != "" {
+		return []string{bin}
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return []string{"pbcopy"}
+	case "linux":
+		if _, err := exec.LookPath("wl-copy"); err == nil {
+			return []string{"wl-copy"}
+		}
+		if _, err := exec.LookPath("xclip"); err == nil {
+			return []string{"xclip", "-selection", "clipboard"}
+		}
+	}
+	return nil
+}
+
+const defaultMaxClipBytes = 1 << 20
+
+// strict turns soft limits (such as PWFZ_MAX_CLIP_BYTES) into errors.
+var strict bool
+
+// checkClipboardSize guards against backends that silently truncate large
+// values. Set PWFZ_MAX_CLIP_BYTES=0 to disable the check.
+func checkClipboardSize(size int) error {
+	limit := envInt("PWFZ_MAX_CLIP_BYTES", defaultMaxClipBytes)
+	if limit <= 0 || size <= limit {
+		return nil
+	}
+	msg := fmt.Sprintf("value is %d bytes, over the %d byte clipboard limit (PWFZ_MAX_CLIP_BYTES); it may be truncated", size, limit)
+	if strict {
+		return errors.New(msg)
+	}
+	warnf("%s", msg)
+	return nil
+}
+
+// openURL opens an http(s) URL in the default browser, or with OPEN_BIN.
+// A URL without a scheme is taken to be https; other schemes are refused
+// so an entry cannot make pwfz open a local file or run a handler.
+func openURL(raw string) error {
+	u, err := neturl.Parse(strings.TrimSpace(raw))
+	if err == nil && u.Scheme == "" {
+		u, err = neturl.Parse("https://" + strings.TrimSpace(raw))
+	}
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("cannot open %q: not a valid URL", raw)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("cannot open %q: only http and https URLs are opened", raw)
+	}
+
+	var cmdArgs []string
+	switch {
+	case os.Getenv("OPEN_BIN") != "":
+		cmdArgs = []string{os.Getenv("OPEN_BIN")}
+	case runtime.GOOS == "darwin":
+		cmdArgs = []string{"open"}
+	case runtime.GOOS == "windows":
+		cmdArgs = []string{"rundll32", "url.dll,FileProtocolHandler"}
+	default:
+		cmdArgs = []string{"xdg-open"}
+	}
+	cmd := exec.Command(cmdArgs[0], append(cmdArgs[1:], u.String())...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("open %s: %w", u, err)
+	}
+	return nil
+}
+
+func detectPasteCommand() []string {
+	if bin := os.Getenv("PASTE_BIN"); bin != "" {
+		return []string{bin}
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return []string{"pbpaste"}
+	case "linux":
+		if _, err := exec.LookPath("wl-paste"); err == nil {
+			return []string{"wl-paste", "--no-newline"}
+		}
+		if _, err := exec.LookPath("xclip"); err == nil {
+			return []string{"xclip", "-selection", "clipboard", "-o"}
+		}
+	}
+	return nil
+}
+
+// readClipboard returns the current clipboard text, trimmed.
+func readClipboard() (string, error) {
+	cmdArgs := detectPasteCommand()
+	if cmdArgs == nil {
+		return "", errors.New("no paste command found (set PASTE_BIN or install pbpaste/xclip/wl-paste)")
+	}
+	cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// savedClipboard holds the clipboard contents from before pwfz copied a
+// secret, for PWFZ_CLIP_RESTORE.
+type savedClipboard struct {
+	data []byte
+	ok   bool // false when the old contents could not be read back as text
+}
+
+// saveClipboard snapshots the clipboard. Contents that are not valid text
+// (an image, say) cannot be written back through the copy command, so they
+// are recorded as not ok and the clipboard is cleared instead on restore.
+func saveClipboard() savedClipboard {
+	cmdArgs := detectPasteCommand()
+	if cmdArgs == nil {
+		return savedClipboard{}
+	}
+	out, err := exec.Command(cmdArgs[0], cmdArgs[1:]...).Output()
+	if err != nil || !utf8.Valid(out) {
+		debugf("clipboard contents not restorable: %v", err)
+		return savedClipboard{}
+	}
+	return savedClipboard{data: out, ok: true}
+}
+
+// restoreClipboard puts the saved contents back, unless the clipboard no
+// longer holds secret (the user copied something else in the meantime).
+// Saved contents that are not text clear the clipboard instead.
+func restoreClipboard(saved savedClipboard, secret []byte) error {
+	if cur, err := readClipboard(); err == nil && !bytes.Equal([]byte(cur), bytes.TrimSpace(secret)) {
+		debugf("clipboard changed since the copy, not restoring")
+		return nil
+	}
+	return copyToClipboard(saved.data)
+}
+
+// restoreClipboardCommand is the hidden subcommand run by scheduleRestore.
+const restoreClipboardCommand = "__restore-clipboard"
+
+// restoreJob is what scheduleRestore hands its child over stdin.
+type restoreJob struct {
+	Secret []byte `json:"secret"`
+	Saved  []byte `json:"saved"`
+	OK     bool   `json:"ok"`
+}
+
+// scheduleRestore starts a detached copy of pwfz that puts the saved
+// clipboard back after PWFZ_CLIP_RESTORE_AFTER seconds (default 30), the
+// way scheduleClear clears it, so the shell gets its prompt back at once.
+func scheduleRestore(saved savedClipboard, secret []byte) error {
+	secs := max(envInt("PWFZ_CLIP_RESTORE_AFTER", 30), 0)
+	job, err := json.Marshal(restoreJob{Secret: secret, Saved: saved.data, OK: saved.ok})
+	if err != nil {
+		return err
+	}
+	defer clear(job)
+	if err := startDetached(job, restoreClipboardCommand, strconv.Itoa(secs)); err != nil {
+		return err
+	}
+	if !saved.ok {
+		warnf("previous clipboard contents are not text; the clipboard will be cleared instead")
+	}
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "Restoring the previous clipboard in %ds.\n", secs)
+	}
+	return nil
+}
+
+// restoreClipboardMain is the detached half of scheduleRestore.
+func restoreClipboardMain(args []string) {
+	signal.Ignore(syscall.SIGHUP, os.Interrupt)
+	if len(args) != 1 {
+		os.Exit(2)
+	}
+	secs, err := strconv.Atoi(args[0])
+	if err != nil {
+		os.Exit(2)
+	}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		os.Exit(1)
+	}
+	var job restoreJob
+	err = json.Unmarshal(data, &job)
+	clear(data)
+	if err != nil {
+		os.Exit(2)
+	}
+	time.Sleep(time.Duration(secs) * time.Second)
+	err = restoreClipboard(savedClipboard{data: job.Saved, ok: job.OK}, job.Secret)
+	clear(job.Secret)
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// startDetached runs a hidden pwfz subcommand in the background, feeding it
+// stdin over a pipe rather than argv, and does not wait for it.
+func startDetached(stdin []byte, args ...string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, args...)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if _, err := in.Write(stdin); err != nil {
+		return err
+	}
+	if err := in.Close(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// clearClipboardCommand is the hidden subcommand run by scheduleClear.
+const clearClipboardCommand = "__clear-clipboard"
+
+// scheduleClear starts a detached copy of pwfz that empties the clipboard
+// after PWFZ_CLEAR_SECONDS (default 45, 0 = never), so the secret does not
+// outlive this process. The value travels over the child's stdin, never
+// argv, and is only used to check the clipboard still holds it.
+func scheduleClear(value []byte) error {
+	secs := envInt("PWFZ_CLEAR_SECONDS", 45)
+	if secs <= 0 {
+		return nil
+	}
+	if err := startDetached(value, clearClipboardCommand, strconv.Itoa(secs)); err != nil {
+		return err
+	}
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "Clearing the clipboard in %ds.\n", secs)
+	}
+	return nil
+}
+
+// clearClipboardMain is the detached half of scheduleClear. It survives the
+// terminal closing and wipes the clipboard only if it still holds the value
+// it was handed, so anything copied in the meantime is left alone.
+func clearClipboardMain(args []string) {
+	signal.Ignore(syscall.SIGHUP, os.Interrupt)
+	if len(args) != 1 {
+		os.Exit(2)
+	}
+	secs, err := strconv.Atoi(args[0])
+	if err != nil {
+		os.Exit(2)
+	}
+	value, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		os.Exit(1)
+	}
+	time.Sleep(time.Duration(secs) * time.Second)
+	changed := false
+	if cur, err := readClipboard(); err == nil && !bytes.Equal([]byte(cur), bytes.TrimSpace(value)) {
+		changed = true
+	}
+	clear(value)
+	if changed {
+		return
+	}
+	if err := copyToClipboard(nil); err != nil {
+		os.Exit(1)
+	}
+}
+
+// snapshotClipboard saves the clipboard when PWFZ_CLIP_RESTORE is on and
+// reports whether it is. The snapshot is taken locally, so it cannot
+// restore a remote clipboard reached over PWFZ_CLIP_SSH.
+func snapshotClipboard() (savedClipboard, bool) {
+	if !envBool("PWFZ_CLIP_RESTORE") {
+		return savedClipboard{}, false
+	}
+	if host, ssh := sshClipboardCommand(); ssh != nil {
+		warnf("PWFZ_CLIP_RESTORE is ignored with PWFZ_CLIP_SSH=%s", host)
+		return savedClipboard{}, false
+	}
+	return saveClipboard(), true
+}
+
+// scheduleCleanup takes a copied value off the clipboard later: it restores
+// the snapshot when restore is on and clears the clipboard otherwise. A
+// remote clipboard cannot be checked before clearing, so it is left as is.
+func scheduleCleanup(value []byte, saved savedClipboard, restore bool) {
+	switch {
+	case restore:
+		if err := scheduleRestore(saved, value); err != nil {
+			warnf("could not schedule restoring the clipboard: %v", err)
+		}
+	case os.Getenv("PWFZ_CLIP_SSH") == "":
+		if err := scheduleClear(value); err != nil {
+			warnf("could not schedule clipboard clearing: %v", err)
+		}
+	}
+}
+
+// sshClipboardCommand returns the ssh invocation that pipes the value into a
+// remote clipboard when PWFZ_CLIP_SSH is set, or nil otherwise.
+func sshClipboardCommand() (string, []string) {
+	host := strings.TrimSpace(os.Getenv("PWFZ_CLIP_SSH"))
+	if host == "" {
+		return "", nil
+	}
+	remote := strings.TrimSpace(os.Getenv("PWFZ_CLIP_SSH_CMD"))
+	if remote == "" {
+		remote = "pbcopy"
+	}
+	return host, []string{"ssh", "-T", host, remote}
+}
+
+// copyToClipboard pipes data to the clipboard command. It keeps no copy of
+// data; callers holding a secret zero their slice when they are done.
+func copyToClipboard(data []byte) error {
+	if err := checkClipboardSize(len(data)); err != nil {
+		return err
+	}
+	host, cmdArgs := sshClipboardCommand()
+	if cmdArgs != nil {
+		warnf("sending the value over SSH to the clipboard on %s", host)
+	} else {
+		cmdArgs = detectClipboardCommand()
+	}
+	if envBool("PWFZ_OSC52") || cmdArgs == nil {
+		err := copyViaOSC52(data)
+		if err != nil && cmdArgs == nil {
+			return fmt.Errorf("no clipboard command found (set CLIP_BIN or install pbcopy/xclip/wl-copy), and OSC 52 failed: %w", err)
+		}
+		return err
+	}
+	cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	return cmd.Run()
+}
+
+// copyViaOSC52 asks the terminal emulator to set the clipboard with an OSC
+// 52 escape written to the controlling terminal, which reaches the local
+// machine even over SSH. Inside tmux or screen the escape is wrapped so it
+// passes through to the outer terminal. Terminals may cap the size or
+// ignore OSC 52 entirely; there is no way to tell from here.
+func copyViaOSC52(data []byte) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("open terminal: %w", err)
+	}
+	defer tty.Close()
+
+	seq := []byte("\x1b]52;c;" + base64.StdEncoding.EncodeToString(data) + "\a")
+	switch {
+	case os.Getenv("TMUX") != "":
+		seq = slices.Concat([]byte("\x1bPtmux;"), bytes.ReplaceAll(seq, []byte("\x1b"), []byte("\x1b\x1b")), []byte("\x1b\\"))
+	case os.Getenv("STY") != "":
+		seq = slices.Concat([]byte("\x1bP"), seq, []byte("\x1b\\"))
+	}
+	defer clear(seq)
+	debugf("copying through OSC 52 (%d bytes)", len(data))
+	_, err = tty.Write(seq)
+	return err
+}
+
+func shellCommand(cmdline string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", cmdline)
+	}
+	return exec.Command("sh", "-c", cmdline)
+}
+
+// writeToFD writes value to an already-open file descriptor inherited from
+// the parent (e.g. "3>secret.pipe"), then closes it.
+func writeToFD(fd int, value []byte) error {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+	if f == nil {
+		return fmt.Errorf("file descriptor %d is not valid", fd)
+	}
+	defer f.Close()
+	if _, err := f.Stat(); err != nil {
+		return fmt.Errorf("file descriptor %d is not open: %w", fd, err)
+	}
+	if _, err := f.Write(value); err != nil {
+		return fmt.Errorf("write to file descriptor %d: %w", fd, err)
+	}
+	return nil
+}
+
+// runPasteAppCommand runs PWFZ_PASTE_APP_CMD (e.g. to focus a VPN client)
+// after the password has been copied. The secret is never passed to it.
+func runPasteAppCommand() error {
+	cmdline := strings.TrimSpace(os.Getenv("PWFZ_PASTE_APP_CMD"))
+	if cmdline == "" {
+		return nil
+	}
+	cmd := shellCommand(cmdline)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// ringBell gives audible confirmation of a successful copy when PWFZ_BELL
+// is set: it runs PWFZ_BELL_CMD if configured, otherwise writes a terminal
+// bell to stderr. Nothing happens under -quiet or when stderr is not a TTY.
+func ringBell() {
+	if !envBool("PWFZ_BELL") || quiet || !isTerminal(os.Stderr) {
+		return
+	}
+	if cmdline := strings.TrimSpace(os.Getenv("PWFZ_BELL_CMD")); cmdline != "" {
+		cmd := shellCommand(cmdline)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			warnf("bell command failed: %v", err)
+		}
+		return
+	}
+	fmt.Fprint(os.Stderr, "\a")
+}
+
+// -----------------------------------------------------------------------------
+// output charset
+// -----------------------------------------------------------------------------
+
+// stdout receives all regular program output. It is re-pointed at a
+// transcoding writer when PWFZ_OUTPUT_CHARSET selects a non-UTF-8 charset.
+var (
+	stdout    io.Writer = os.Stdout
+	outputEnc *encoding.Encoder
+)
+
+// setupOutputCharset applies PWFZ_OUTPUT_CHARSET (e.g. iso-8859-1,
+// windows-1251, koi8-r). Unset or UTF-8 means passthrough. Copied secrets
+// and JSON output never go through this path.
+func setupOutputCharset() error {
+	name := strings.TrimSpace(os.Getenv("PWFZ_OUTPUT_CHARSET"))
+	if name == "" {
+		return nil
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return fmt.Errorf("PWFZ_OUTPUT_CHARSET=%s: %w", name, err)
+	}
+	if enc == unicode.UTF8 {
+		return nil
+	}
+	outputEnc = encoding.ReplaceUnsupported(enc.NewEncoder())
+	stdout = outputEnc.Writer(os.Stdout)
+	return nil
+}
+
+// writeJSON prints a JSON document and a newline to the raw stdout. JSON
+// is UTF-8 by definition, and -json output carries the password, so it is
+// never transcoded.
+func writeJSON(doc []byte) error {
+	if _, err := os.Stdout.Write(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(os.Stdout, "\n")
+	return err
+}
+
+// encodeOutput transcodes text shown to the user (fzf lines, headers).
+func encodeOutput(s string) string {
+	if outputEnc == nil {
+		return s
+	}
+	out, err := outputEnc.String(s)
+	if err != nil {
+		return s
+	}
+	return out
+}
+
+// -----------------------------------------------------------------------------
+// formatting helpers
+// -----------------------------------------------------------------------------
+
+// envInt reads an integer env var, falling back to def (with a warning)
+// when it is unset or malformed.
+func envInt(name string, def int) int {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		warnf("ignoring invalid %s=%q", name, v)
+		return def
+	}
+	return n
+}
+
+// envDuration reads a Go duration such as "30s" from the environment.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		warnf("ignoring invalid %s=%q", name, v)
+		return def
+	}
+	return d
+}
+
+// envBool reports whether an env var is set to a truthy value.
+func envBool(name string) bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv(name))) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
+
+func orDash(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return "-"
+	}
+	return s
+}
+
+func orEmpty(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return ""
+	}
+	return s
+}
+
+func decodeB64OrRaw(s string) string {
+	if b, ok := decodeFlexibleB64(s); ok {
+		return b
+	}
+	return s
+}
+
+// flexibleB64 lists the base64 variants values are found in, most common
+// first; some clients write the URL-safe alphabet or drop the padding.
+var flexibleB64 = []*base64.Encoding{
+	base64.StdEncoding,
+	base64.RawStdEncoding,
+	base64.URLEncoding,
+	base64.RawURLEncoding,
+}
+
+// decodeFlexibleB64 decodes s with the first base64 variant that accepts
+// it and yields text (or a client-side encrypted blob). A plain value that
+// merely happens to be valid base64 decodes to binary and is rejected.
+func decodeFlexibleB64(s string) (string, bool) {
+	b, ok := decodeFlexibleB64Bytes(s)
+	return string(b), ok
+}
+
+// decodeFlexibleB64Bytes is decodeFlexibleB64 for secrets: the caller owns
+// the result and can zero it.
+func decodeFlexibleB64Bytes(s string) ([]byte, bool) {
+	for _, enc := range flexibleB64 {
+		b, err := enc.DecodeString(s)
+		if err == nil && (bytes.HasPrefix(b, saltedMagic) || isPrintable(b)) {
+			return b, true
+		}
+		clear(b)
+	}
+	return nil, false
+}
+
+// isPrintable reports whether b is UTF-8 text without control characters
+// other than tab and line breaks.
+func isPrintable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if (r < 0x20 && r != '\t' && r != '\n' && r != '\r') || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldPair is a custom field with its name and value decoded.
+type fieldPair struct {
+	Name, Value string
+}
+
+// decodedCustomFields returns p's custom fields in order, with names and
+// values base64-decoded where the server encoded them.
+func decodedCustomFields(p passwordDetail) []fieldPair {
+	fields := make([]fieldPair, 0, len(p.Custom))
+	for _, c := range p.Custom {
+		fields = append(fields, fieldPair{decodeB64OrRaw(c.Name), decodeB64OrRaw(c.Value)})
+	}
+	return fields
+}
+
+func formatDescription(p passwordDetail) string {
+	if len(p.Custom) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(p.Custom))
+	for _, f := range decodedCustomFields(p) {
+		// Multi-line values (backup codes, keys) would break the one
+		// entry per line layout of fzf and -list.
+		name := strings.Join(strings.Fields(f.Name), " ")
+		val := strings.Join(strings.Fields(f.Value), " ")
+		if name == "" && val == "" {
+			continue
+		}
+		if name == "" {
+			parts = append(parts, val)
+		} else if val == "" {
+			parts = append(parts, name)
+		} else {
+			parts = append(parts, fmt.Sprintf("%s=%s", name, val))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+func formatPath(path []pathSegment) string {
+	if len(path) == 0 {
+		return ""
+	}
+	// sort by order just in case
+	sort.Slice(path, func(i, j int) bool {
+		return path[i].Order < path[j].Order
+	})
+	names := make([]string, 0, len(path))
+	for _, p := range path {
+		if orEmpty(p.Name) != "" {
+			names = append(names, p.Name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return strings.Join(names, " / ")
+}
+
+// vaultName returns the name of the vault an entry lives in: the one
+// nameVaults looked up, else the vault segment of its path, else the raw
+// vault ID.
+func vaultName(p passwordDetail) string {
+	if p.vault != "" {
+		return p.vault
+	}
+	for _, seg := range p.Path {
+		if strings.EqualFold(seg.Type, "vault") && orEmpty(seg.Name) != "" {
+			return seg.Name
+		}
+	}
+	return orDash(p.VaultID)
+}
+
+// nameVaults sets the vault name of each of details, all from one server,
+// from the server's vault list. The path is no help for entries whose path
+// holds only folders, or nothing at all. Without the list, vaultName falls
+// back to the path and the ID.
+func nameVaults(ctx context.Context, cfg Config, client *http.Client, token string, details []passwordDetail) {
+	vaults, err := cachedVaults(ctx, cfg, client, token)
+	if err != nil {
+		debugf("cannot list vaults, naming them from entry paths: %v", err)
+		return
+	}
+	names := make(map[string]string, len(vaults))
+	for _, v := range vaults {
+		names[v.ID] = v.Name
+	}
+	for i := range details {
+		if name := orEmpty(names[details[i].VaultID]); name != "" {
+			details[i].vault = name
+		}
+	}
+}
+
+// needVaultNames reports whether anything shows vault names: grouping by
+// vault or a vault column.
+func (o *filterOptions) needVaultNames() bool {
+	return o.groupByVault || slices.Contains(lineFields, "vault")
+}
+
+// groupHeaderID marks non-selectable separator lines in the picker.
+const groupHeaderID = "#group"
+
+func buildGroupHeaderLine(vault string) string {
+	return fmt.Sprintf("%s\t%s", groupHeaderID, dim("── "+vault+" ──"))
+}
+
+// entryColors maps Passwork's entry color codes, in the order of the web
+// UI's color picker, to ANSI foreground colors. 0 and unknown codes mean
+// no color.
+var entryColors = map[int]string{
+	1: "31", // red
+	2: "33", // orange
+	3: "93", // yellow
+	4: "32", // green
+	5: "36", // turquoise
+	6: "34", // blue
+	7: "35", // purple
+	8: "90", // gray
+}
+
+// colorFor returns the SGR sequence that starts Passwork color code, or ""
+// for no color or when NO_COLOR is set.
+func colorFor(code int) string {
+	c, ok := entryColors[code]
+	if !ok || os.Getenv("NO_COLOR") != "" {
+		return ""
+	}
+	return "\x1b[" + c + "m"
+}
+
+// dim renders s faint, unless NO_COLOR is set.
+func dim(s string) string {
+	if os.Getenv("NO_COLOR") != "" {
+		return s
+	}
+	return "\x1b[2m" + s + "\x1b[0m"
+}
+
+// lineColumns are the -fields column names, each rendering one part of
+// an entry's line.
+var lineColumns = map[string]func(p passwordDetail) string{
+	"name": func(p passwordDetail) string {
+		name := orEmpty(p.Name)
+		if c := colorFor(p.Color); c != "" && name != "" {
+			name = c + name + "\x1b[0m"
+		}
+		return name
+	},
+	"path":        func(p passwordDetail) string { return orDash(formatPath(p.Path)) },
+	"login":       func(p passwordDetail) string { return orEmpty(p.Login) },
+	"url":         func(p passwordDetail) string { return orEmpty(p.URL) },
+	"description": formatDescription,
+	"tags": func(p passwordDetail) string {
+		var tags []string
+		for _, t := range p.Tags {
+			if t = strings.TrimSpace(t); t != "" {
+				tags = append(tags, "#"+t)
+			}
+		}
+		if len(tags) == 0 {
+			return ""
+		}
+		return dim(strings.Join(tags, " "))
+	},
+	"vault": vaultName,
+	"id":    func(p passwordDetail) string { return p.ID },
+}
+
+// lineFields is the -fields column list, in display order.
+var lineFields = []string{"name", "path", "login", "url", "description", "tags"}
+
+// parseFields validates a -fields list against lineColumns.
+func parseFields(spec string) ([]string, error) {
+	var fields []string
+	for _, f := range strings.Split(spec, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" {
+			continue
+		}
+		if lineColumns[f] == nil {
+			known := slices.Sorted(maps.Keys(lineColumns))
+			return nil, fmt.Errorf("unknown field %q (want %s)", f, strings.Join(known, ", "))
+		}
+		if !slices.Contains(fields, f) {
+			fields = append(fields, f)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("no fields given")
+	}
+	return fields, nil
 }
 
 func buildFzfLine(p passwordDetail) string {
-	name := orEmpty(p.Name)
-	pathStr := orDash(formatPath(p.Path))
-	desc := formatDescription(p.Custom)
-
-	// Column 1: ID (hidden by --with-nth=2..)
-	// Column 2..: user-visible data.
-	display := fmt.Sprintf("%s | %s | %s | %s | %s",
-		name,
-		pathStr,
-		orEmpty(p.Login),
-		orEmpty(p.URL),
-		desc,
-	)
+	// Column 1: ID (hidden by --with-nth=2..), never colored so the ID
+	// split on \t stays exact.
+	// Column 2..: user-visible data, as chosen by -fields.
+	cols := make([]string, len(lineFields))
+	for i, f := range lineFields {
+		cols[i] = lineColumns[f](p)
+	}
+	display := strings.Join(cols, " | ")
+	if p.Archived {
+		display += " [archived]"
+	}
+	if p.lazy {
+		display += " [not loaded]"
+	}
+	if expiringSoon(p, time.Now(), expiryWindow()) {
+		display = "⚠ " + display
+	}
+	if p.src != nil && p.src.tag != "" {
+		display = "[" + p.src.tag + "] " + display
+	}
+
+	return fmt.Sprintf("%s	%s", fzfKey(p), display)
+}
+
+// fzfKey is the hidden first fzf column identifying p. IDs are only unique
+// per instance, so federated entries are prefixed with their instance tag.
+func fzfKey(p passwordDetail) string {
+	if p.src != nil && p.src.tag != "" {
+		return p.src.tag + "/" + p.ID
+	}
+	return p.ID
+}
+
+// -----------------------------------------------------------------------------
+// preview
+// -----------------------------------------------------------------------------
+
+// previewCommand is the hidden subcommand fzf runs for --preview.
+const previewCommand = "__preview"
+
+// renderPreview formats p for the fzf preview window. The password is never
+// included, and custom fields of type password or totp are masked.
+func renderPreview(p passwordDetail) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Name:     %s\n", orEmpty(p.Name))
+	if p.lazy {
+		b.WriteString("\n(details not loaded yet; they are fetched on selection)\n")
+		return b.String()
+	}
+	fmt.Fprintf(&b, "Path:     %s\n", orDash(formatPath(p.Path)))
+	fmt.Fprintf(&b, "Login:    %s\n", orDash(p.Login))
+	fmt.Fprintf(&b, "URL:      %s\n", orDash(p.URL))
+	fmt.Fprintf(&b, "Tags:     %s\n", orDash(strings.Join(p.Tags, ", ")))
+	fmt.Fprintf(&b, "Color:    %d\n", p.Color)
+	if t, ok := p.Expires.time(); ok {
+		fmt.Fprintf(&b, "Expires:  %s\n", t.Format("2006-01-02"))
+	}
+	if p.Archived {
+		b.WriteString("Archived: yes\n")
+	}
+	if len(p.Custom) > 0 {
+		b.WriteString("\nCustom fields:\n")
+		for _, c := range p.Custom {
+			val := decodeB64OrRaw(c.Value)
+			switch strings.ToLower(c.Type) {
+			case "password", "totp":
+				val = "••••••"
+			}
+			val = strings.ReplaceAll(val, "\n", "\n    ")
+			fmt.Fprintf(&b, "  %s: %s\n", orDash(decodeB64OrRaw(c.Name)), val)
+		}
+	}
+	if len(p.Attachments) > 0 {
+		b.WriteString("\nAttachments:\n")
+		for _, a := range p.Attachments {
+			fmt.Fprintf(&b, "  %s\n", orDash(a.Name))
+		}
+	}
+	return b.String()
+}
+
+// writePreviewFile stores the rendered preview of every entry, keyed like
+// the fzf lines, in a private temp file for previewMain to read. The caller
+// removes it.
+func writePreviewFile(details []passwordDetail) (string, error) {
+	previews := make(map[string]string, len(details))
+	for _, d := range details {
+		previews[fzfKey(d)] = renderPreview(d)
+	}
+	data, err := json.Marshal(previews)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp("", "pwfz-preview-*.json")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// previewArgs returns the fzf flags that show previews from file.
+func previewArgs(file string) ([]string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := fmt.Sprintf("%s %s %s {1}", shellQuote(exe), previewCommand, shellQuote(file))
+	return []string{"--preview=" + cmd, "--preview-window=right,50%,wrap"}, nil
+}
+
+// shellQuote quotes s for the POSIX shell fzf runs the preview command in.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// previewMain prints the stored preview for one fzf key.
+func previewMain(args []string) {
+	if len(args) != 2 {
+		os.Exit(2)
+	}
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var previews map[string]string
+	if err := json.Unmarshal(data, &previews); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Fprint(stdout, previews[args[1]])
+}
+
+// -----------------------------------------------------------------------------
+// copy modes
+// -----------------------------------------------------------------------------
+
+// decodePassword returns the plaintext of the entry's cryptedPassword.
+func decodePassword(p passwordDetail) (string, error) {
+	pw, err := passwordBytes(p)
+	defer clear(pw)
+	return string(pw), err
+}
+
+// passwordBytes is decodePassword without a string copy of the plaintext:
+// the caller owns the slice and zeros it when done.
+func passwordBytes(p passwordDetail) ([]byte, error) {
+	if p.CryptedPassword == "" {
+		return nil, errors.New("selected entry has empty cryptedPassword")
+	}
+
+	// cryptedPassword is base64-encoded – decode before copying
+	decoded, ok := decodeFlexibleB64Bytes(p.CryptedPassword)
+	if !ok {
+		// If decoding fails for some reason, fall back to raw value
+		warnf("cannot base64-decode cryptedPassword, copying raw value")
+		return []byte(p.CryptedPassword), nil
+	}
+	if !bytes.HasPrefix(decoded, saltedMagic) {
+		return decoded, nil
+	}
+	mp, err := masterPassword()
+	if err != nil {
+		return nil, err
+	}
+	return decryptPassword(p, mp)
+}
+
+// saltedMagic starts the OpenSSL/CryptoJS AES format that client-side
+// (master-password) encryption produces: "Salted__", 8 bytes of salt, then
+// the AES-256-CBC ciphertext.
+var saltedMagic = []byte("Salted__")
+
+// decryptPassword decrypts a cryptedPassword written under client-side
+// encryption. The key and IV are derived from the master password and the
+// embedded salt with EVP_BytesToKey (MD5), as CryptoJS does.
+func decryptPassword(p passwordDetail, masterPassword string) ([]byte, error) {
+	raw, ok := decodeFlexibleB64Bytes(p.CryptedPassword)
+	if !ok {
+		return nil, fmt.Errorf("entry %q: cryptedPassword is not base64", p.Name)
+	}
+	if !bytes.HasPrefix(raw, saltedMagic) {
+		return raw, nil
+	}
+	if len(raw) < 16+aes.BlockSize || (len(raw)-16)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("entry %q: encrypted password is truncated", p.Name)
+	}
+	salt, ct := raw[8:16], raw[16:]
+
+	key, iv := evpBytesToKey([]byte(masterPassword), salt, 32, aes.BlockSize)
+	defer clear(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	pt := make([]byte, len(ct))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(pt, ct)
+
+	// PKCS#7 padding; a mismatch almost always means a wrong master password.
+	n := int(pt[len(pt)-1])
+	if n == 0 || n > aes.BlockSize || !bytes.Equal(pt[len(pt)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		clear(pt)
+		return nil, fmt.Errorf("entry %q: cannot decrypt password (wrong master password?)", p.Name)
+	}
+	return pt[:len(pt)-n], nil
+}
+
+// evpBytesToKey is OpenSSL's legacy key derivation with MD5 and one round.
+func evpBytesToKey(password, salt []byte, keyLen, ivLen int) (key, iv []byte) {
+	var out, prev []byte
+	for len(out) < keyLen+ivLen {
+		h := md5.New()
+		h.Write(prev)
+		h.Write(password)
+		h.Write(salt)
+		prev = h.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:keyLen], out[keyLen : keyLen+ivLen]
+}
+
+// masterPassword returns PWFZ_MASTER_PASSWORD, or asks for it once on the
+// terminal without echo. It is only needed for client-side encrypted entries.
+var masterPassword = sync.OnceValues(func() (string, error) {
+	if mp := os.Getenv("PWFZ_MASTER_PASSWORD"); mp != "" {
+		return mp, nil
+	}
+	if !isTerminal(os.Stdin) {
+		return "", errors.New("entry uses client-side encryption; set PWFZ_MASTER_PASSWORD or run in a terminal")
+	}
+	fmt.Fprint(os.Stderr, "Master password: ")
+	b, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("read master password: %w", err)
+	}
+	return string(b), nil
+})
+
+// extractJSONKey looks up a dotted key path (e.g. "db.password" or
+// "replicas.0.host") in a JSON document. Strings are returned verbatim,
+// anything else as compact JSON.
+func extractJSONKey(decoded, key string) (string, error) {
+	var v any
+	if err := json.Unmarshal([]byte(decoded), &v); err != nil {
+		return "", fmt.Errorf("value is not JSON: %w", err)
+	}
+	for _, part := range strings.Split(key, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			next, ok := node[part]
+			if !ok {
+				return "", fmt.Errorf("JSON key %q not found", key)
+			}
+			v = next
+		case []any:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", fmt.Errorf("JSON key %q not found", key)
+			}
+			v = node[i]
+		default:
+			return "", fmt.Errorf("JSON key %q not found", key)
+		}
+	}
+	if str, ok := v.(string); ok {
+		return str, nil
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// copyOptions controls what valueToCopy extracts from the selected entry.
+type copyOptions struct {
+	mode     string // -copy
+	caseMode string // -copy-case, applied to text fields only
+	visible  int    // -mask-visible, for -copy masked
+	nth      int    // -copy-nth, 1-based item of a multi-valued custom field
+	field    string // -copy-field, shorthand for -copy custom:NAME
+}
+
+func addCopyFlags(fs *flag.FlagSet) *copyOptions {
+	o := &copyOptions{}
+	fs.StringVar(&o.mode, "copy", "password", "what to copy: password, login, url, url-with-creds, dotenv, masked, custom:NAME (a custom field), or json-key:`KEY` (dotted path into a JSON password)")
+	fs.StringVar(&o.caseMode, "copy-case", "none", "normalize a copied login/url: lower, upper, or none")
+	fs.IntVar(&o.visible, "mask-visible", 2, "characters kept at each end by -copy masked")
+	fs.StringVar(&o.field, "copy-field", "", "copy the custom field called `name` (case-insensitive) instead of the password")
+	fs.IntVar(&o.nth, "copy-nth", 0, "with -copy custom:NAME, copy only item `N` (1-based) of the field split on PWFZ_FIELD_SEP")
+	return o
+}
+
+// copyModes lists the -copy mode names valueToCopy understands, so a typo is
+// reported before any network traffic.
+var copyModes = map[string]bool{
+	"password": true,
+	"login":    true,
+	"url":      true,
+	"json-key": true,
+	"dotenv":   true,
+	"masked":   true,
+	"custom":   true,
+	// url-with-creds embeds the decoded password, so like password it is
+	// only ever written to the clipboard, -output-fd or -stdout.
+	"url-with-creds": true,
+}
+
+func (o *copyOptions) check() error {
+	if o.field != "" {
+		if o.mode != "password" {
+			return errors.New("-copy-field cannot be combined with -copy")
+		}
+		o.mode = "custom:" + o.field
+	}
+	name, _, _ := strings.Cut(o.mode, ":")
+	if !copyModes[name] {
+		return fmt.Errorf("unknown -copy mode %q", o.mode)
+	}
+	switch o.caseMode {
+	case "none", "lower", "upper":
+	default:
+		return fmt.Errorf("unknown -copy-case %q (want lower, upper, or none)", o.caseMode)
+	}
+	if o.nth != 0 && name != "custom" {
+		return errors.New("-copy-nth only applies to -copy custom:NAME or -copy-field")
+	}
+	if o.nth < 0 {
+		return errors.New("-copy-nth must be positive")
+	}
+	return nil
+}
+
+// applyCase normalizes text fields; it is never used on secrets.
+func applyCase(s, caseMode string) string {
+	switch caseMode {
+	case "lower":
+		return strings.ToLower(s)
+	case "upper":
+		return strings.ToUpper(s)
+	}
+	return s
+}
+
+// envVarName turns an arbitrary field name into a valid env var name:
+// uppercase, with every non-alphanumeric rune replaced by '_'.
+func envVarName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(strings.TrimSpace(name)) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	out := b.String()
+	if out == "" || (out[0] >= '0' && out[0] <= '9') {
+		out = "_" + out
+	}
+	return out
+}
+
+// dotenvQuote leaves simple values bare and double-quotes everything else.
+func dotenvQuote(v string) string {
+	plain := v != ""
+	for _, r := range v {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("_-.,/:@+", r)) {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return v
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(v) + `"`
+}
+
+// urlWithCreds returns the entry's URL with login and password embedded as
+// percent-encoded userinfo, e.g. for git clone or database DSNs.
+func urlWithCreds(p passwordDetail, password string) (string, error) {
+	u, err := neturl.Parse(strings.TrimSpace(p.URL))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("entry %q has no parseable URL (need scheme://host, got %q)", p.Name, p.URL)
+	}
+	if orEmpty(p.Login) == "" {
+		return "", fmt.Errorf("entry %q has no login", p.Name)
+	}
+	u.User = neturl.UserPassword(p.Login, password)
+	return u.String(), nil
+}
+
+// formatDotenv renders the entry's custom fields plus its password as
+// NAME=value lines suitable for a .env file.
+func formatDotenv(p passwordDetail, password string) string {
+	var b strings.Builder
+	for _, f := range decodedCustomFields(p) {
+		if orEmpty(f.Name) == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "%s=%s\n", envVarName(f.Name), dotenvQuote(f.Value))
+	}
+	fmt.Fprintf(&b, "PASSWORD=%s\n", dotenvQuote(password))
+	return b.String()
+}
+
+// customFieldValue returns the decoded value of the custom field whose
+// decoded name matches name case-insensitively.
+func customFieldValue(p passwordDetail, name string) (string, error) {
+	var names []string
+	for _, f := range decodedCustomFields(p) {
+		if strings.EqualFold(strings.TrimSpace(f.Name), strings.TrimSpace(name)) {
+			return f.Value, nil
+		}
+		if orEmpty(f.Name) != "" {
+			names = append(names, f.Name)
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("entry %q has no custom fields", p.Name)
+	}
+	return "", fmt.Errorf("entry %q has no custom field %q (available: %s)", p.Name, name, strings.Join(names, ", "))
+}
+
+// fieldSeparator returns PWFZ_FIELD_SEP (default newline); the escapes \n
+// and \t are understood so they can be set from a shell easily.
+func fieldSeparator() string {
+	sep := os.Getenv("PWFZ_FIELD_SEP")
+	if sep == "" {
+		return "\n"
+	}
+	return strings.NewReplacer(`\n`, "\n", `\t`, "\t").Replace(sep)
+}
+
+// nthItem splits a multi-valued field on sep and returns the 1-based nth
+// non-empty item.
+func nthItem(value, sep string, n int) (string, error) {
+	var items []string
+	for _, it := range strings.Split(value, sep) {
+		if it = strings.TrimSpace(it); it != "" {
+			items = append(items, it)
+		}
+	}
+	if n < 1 || n > len(items) {
+		return "", fmt.Errorf("-copy-nth %d out of range: field has %d item(s)", n, len(items))
+	}
+	return items[n-1], nil
+}
+
+// maskSecret keeps the first and last n runes and replaces the middle with a
+// fixed-width run of bullets, so the mask does not reveal the length. Values
+// too short to keep both ends are masked completely.
+func maskSecret(s string, n int) string {
+	const bullets = "•••••"
+	r := []rune(s)
+	if n < 0 {
+		n = 0
+	}
+	if len(r) <= 2*n {
+		return bullets
+	}
+	return string(r[:n]) + bullets + string(r[len(r)-n:])
+}
+
+// valueToCopy resolves the -copy mode to the value to copy and a short label
+// for the confirmation message. The caller owns the value and zeros it when
+// done. The plain password is decoded straight into it, never into a string.
+func valueToCopy(p passwordDetail, o copyOptions) ([]byte, string, error) {
+	if name, _, _ := strings.Cut(o.mode, ":"); name == "" || name == "password" {
+		pw, err := passwordBytes(p)
+		return pw, "password", err
+	}
+	value, what, err := textToCopy(p, o)
+	if err != nil {
+		return nil, "", err
+	}
+	return []byte(value), what, nil
+}
+
+// textToCopy resolves the -copy modes that derive text from the entry.
+func textToCopy(p passwordDetail, o copyOptions) (string, string, error) {
+	name, arg, _ := strings.Cut(o.mode, ":")
+	switch name {
+	case "login":
+		if orEmpty(p.Login) == "" {
+			return "", "", fmt.Errorf("entry %q has no login", p.Name)
+		}
+		return applyCase(p.Login, o.caseMode), "login", nil
+	case "url":
+		if orEmpty(p.URL) == "" {
+			return "", "", fmt.Errorf("entry %q has no URL", p.Name)
+		}
+		return applyCase(p.URL, o.caseMode), "URL", nil
+	case "json-key":
+		pw, err := decodePassword(p)
+		if err != nil {
+			return "", "", err
+		}
+		if arg == "" {
+			return pw, "password", nil
+		}
+		if !json.Valid([]byte(pw)) {
+			warnf("password is not JSON, copying the whole value")
+			return pw, "password", nil
+		}
+		val, err := extractJSONKey(pw, arg)
+		if err != nil {
+			return "", "", err
+		}
+		return val, fmt.Sprintf("JSON key %q", arg), nil
+	case "dotenv":
+		pw, err := decodePassword(p)
+		if err != nil {
+			return "", "", err
+		}
+		return formatDotenv(p, pw), ".env block", nil
+	case "url-with-creds":
+		pw, err := decodePassword(p)
+		if err != nil {
+			return "", "", err
+		}
+		val, err := urlWithCreds(p, pw)
+		if err != nil {
+			return "", "", err
+		}
+		return val, "URL with credentials", nil
+	case "masked":
+		pw, err := decodePassword(p)
+		if err != nil {
+			return "", "", err
+		}
+		return maskSecret(pw, o.visible), "masked password", nil
+	case "custom":
+		if arg == "" {
+			return "", "", errors.New("-copy custom needs a field name, e.g. custom:recovery-codes")
+		}
+		val, err := customFieldValue(p, arg)
+		if err != nil {
+			return "", "", err
+		}
+		if o.nth == 0 {
+			return val, fmt.Sprintf("field %q", arg), nil
+		}
+		item, err := nthItem(val, fieldSeparator(), o.nth)
+		if err != nil {
+			return "", "", err
+		}
+		return item, fmt.Sprintf("item %d of field %q", o.nth, arg), nil
+	}
+	return "", "", fmt.Errorf("unknown -copy mode %q", o.mode)
+}
+
+// passwordStrength gives a rough 0-4 score (in the spirit of zxcvbn) from
+// the estimated entropy of the character classes used, discounted for
+// heavily repeated characters.
+func passwordStrength(s string) int {
+	var lower, upper, digit, other bool
+	unique := map[rune]bool{}
+	n := 0
+	for _, r := range s {
+		n++
+		unique[r] = true
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		default:
+			other = true
+		}
+	}
+	pool := 0
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if other {
+		pool += 33
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	bits := float64(n) * math.Log2(float64(pool))
+	if len(unique)*2 < n {
+		bits /= 2
+	}
+	switch {
+	case bits < 28:
+		return 0
+	case bits < 36:
+		return 1
+	case bits < 60:
+		return 2
+	case bits < 128:
+		return 3
+	}
+	return 4
+}
+
+// warnIfWeak prints an advisory when the password scores below
+// PWFZ_MIN_STRENGTH. Only the score is ever printed.
+func warnIfWeak(p passwordDetail, pw string) {
+	want := envInt("PWFZ_MIN_STRENGTH", 3)
+	if score := passwordStrength(pw); score < want {
+		warnf("password for %q looks weak (strength %d/4, want %d); consider rotating it", p.Name, score, want)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// expiry
+// -----------------------------------------------------------------------------
+
+// expiryDate is the entry's password expiry as sent by the server. It
+// accepts a JSON string or a Unix timestamp, so an odd format never breaks
+// decoding of the whole entry.
+type expiryDate string
+
+func (e *expiryDate) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*e = expiryDate(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err == nil {
+		*e = expiryDate(n.String())
+		return nil
+	}
+	*e = ""
+	return nil
+}
+
+var expiryLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// time parses the expiry; ok is false when it is absent or unparseable.
+func (e expiryDate) time() (t time.Time, ok bool) {
+	s := strings.TrimSpace(string(e))
+	if s == "" || s == "0" {
+		return time.Time{}, false
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), true
+	}
+	for _, layout := range expiryLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// expiryWindow reads PWFZ_EXPIRY_WARN (e.g. 7d or 36h), defaulting to 7 days.
+var expiryWindow = sync.OnceValue(func() time.Duration {
+	const def = 7 * 24 * time.Hour
+	v := strings.TrimSpace(os.Getenv("PWFZ_EXPIRY_WARN"))
+	if v == "" {
+		return def
+	}
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return time.Duration(n) * 24 * time.Hour
+		}
+	} else if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return d
+	}
+	warnf("ignoring invalid PWFZ_EXPIRY_WARN=%q", v)
+	return def
+})
+
+// expiringSoon reports whether p's password has expired or expires within
+// the PWFZ_EXPIRY_WARN window.
+func expiringSoon(p passwordDetail, now time.Time, window time.Duration) bool {
+	t, ok := p.Expires.time()
+	return ok && t.Sub(now) <= window
+}
+
+// warnIfExpiring prints a rotation reminder for expired or soon-to-expire
+// passwords. Entries without a usable expiry date are silently skipped.
+func warnIfExpiring(p passwordDetail) {
+	t, ok := p.Expires.time()
+	if !ok {
+		return
+	}
+	left := time.Until(t)
+	switch {
+	case left <= 0:
+		warnf("password for %q expired on %s", p.Name, t.Format("2006-01-02"))
+	case left <= expiryWindow():
+		warnf("password for %q expires on %s", p.Name, t.Format("2006-01-02"))
+	}
+}
+
+// -----------------------------------------------------------------------------
+// TOTP
+// -----------------------------------------------------------------------------
+
+// generateTOTP computes the current RFC 6238 code (SHA1, 30s step, 6 digits)
+// for a base32 secret. otpauth:// URIs are accepted too.
+func generateTOTP(secret string) (string, error) {
+	return totpAt(secret, time.Now())
+}
+
+func totpAt(secret string, t time.Time) (string, error) {
+	secret = strings.TrimSpace(secret)
+	if strings.HasPrefix(secret, "otpauth://") {
+		u, err := neturl.Parse(secret)
+		if err != nil {
+			return "", fmt.Errorf("parse otpauth URI: %w", err)
+		}
+		secret = u.Query().Get("secret")
+	}
+	secret = strings.ToUpper(strings.NewReplacer(" ", "", "-", "", "=", "").Replace(secret))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return "", fmt.Errorf("decode TOTP secret: %w", err)
+	}
+	if len(key) == 0 {
+		return "", errors.New("empty TOTP secret")
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(t.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	off := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000), nil
+}
+
+// findTOTPSecret returns the decoded secret of the entry's first custom
+// field of type "totp", falling back to a field whose name mentions OTP or
+// 2FA.
+func findTOTPSecret(p passwordDetail) (string, bool) {
+	for _, c := range p.Custom {
+		if strings.EqualFold(c.Type, "totp") {
+			if v := orEmpty(decodeB64OrRaw(c.Value)); v != "" {
+				return v, true
+			}
+		}
+	}
+	for _, c := range p.Custom {
+		name := strings.ToLower(decodeB64OrRaw(c.Name))
+		if strings.Contains(name, "otp") || strings.Contains(name, "2fa") {
+			if v := orEmpty(decodeB64OrRaw(c.Value)); v != "" {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Alternative fzf accept keys: they copy the entry's password, current
+// TOTP code or login instead of the -copy value, save one of its
+// attachments, open its URL in the browser, or print its details.
+const (
+	passwordKey = "ctrl-y"
+	totpKey     = "ctrl-t"
+	loginKey    = "ctrl-u"
+	attachKey   = "ctrl-a"
+	openKey     = "ctrl-o"
+	detailsKey  = "ctrl-d"
+)
+
+// actionKeys lists the alternative accept keys in the order the fzf header
+// describes them.
+var actionKeys = []struct{ key, help string }{
+	{passwordKey, "copy password"},
+	{totpKey, "copy TOTP"},
+	{loginKey, "copy login"},
+	{attachKey, "save attachment"},
+	{openKey, "open URL"},
+	{detailsKey, "print details"},
+}
+
+// actionHeader describes Enter and the alternative accept keys for the fzf
+// header, and returns the keys to pass as --expect.
+func actionHeader() (help string, keys []string) {
+	parts := []string{"enter: copy"}
+	for _, a := range actionKeys {
+		parts = append(parts, a.key+": "+a.help)
+		keys = append(keys, a.key)
+	}
+	return strings.Join(parts, " · "), keys
+}
+
+// entryTOTP returns the current TOTP code for p.
+func entryTOTP(p passwordDetail) (string, error) {
+	secret, ok := findTOTPSecret(p)
+	if !ok {
+		return "", fmt.Errorf("entry %q has no TOTP field", p.Name)
+	}
+	return generateTOTP(secret)
+}
+
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// copyPasswordThenTOTP copies the password, waits for Enter, then copies a
+// freshly generated TOTP code for the same entry. Each value is cleared or
+// restored like a single copy, so an abandoned sequence does not leave the
+// password behind either.
+func copyPasswordThenTOTP(p passwordDetail) error {
+	secret, ok := findTOTPSecret(p)
+	if !ok {
+		return fmt.Errorf("entry %q has no TOTP field", p.Name)
+	}
+
+	pw, err := passwordBytes(p)
+	if err != nil {
+		return err
+	}
+	defer clear(pw)
+	saved, restore := snapshotClipboard()
+	if err := copyToClipboard(pw); err != nil {
+		return fmt.Errorf("clipboard error: %w", err)
+	}
+	fmt.Fprintf(stdout, "Copied password for %q to clipboard.\n", p.Name)
+	if err := runPasteAppCommand(); err != nil {
+		warnf("paste app command failed: %v", err)
+	}
+	scheduleCleanup(pw, saved, restore)
+
+	fmt.Fprint(os.Stderr, "Paste it, then press Enter to copy the TOTP code (Ctrl-C to stop): ")
+	if _, err := readLine(bufio.NewReader(os.Stdin)); err != nil {
+		return fmt.Errorf("read keypress: %w", err)
+	}
+
+	code, err := generateTOTP(secret)
+	if err != nil {
+		return err
+	}
+	if err := copyToClipboard([]byte(code)); err != nil {
+		return fmt.Errorf("clipboard error: %w", err)
+	}
+	fmt.Fprintf(stdout, "Copied TOTP code for %q to clipboard.\n", p.Name)
+	scheduleCleanup([]byte(code), saved, restore)
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+// selection pipeline
+// -----------------------------------------------------------------------------
+
+var errAPIKeyWhitespace = errors.New("PASSWORK_API_KEY contains whitespace")
+
+// trimEnv reads an env var with surrounding whitespace removed; values like
+// $(cat keyfile) otherwise carry a trailing newline into the request URL.
+func trimEnv(name string) string {
+	raw := os.Getenv(name)
+	v := strings.TrimSpace(raw)
+	if v != raw {
+		debugf("trimmed surrounding whitespace from %s", name)
+	}
+	return v
+}
+
+// apiPath is the Passwork API root, added to a base URL that names only
+// the host.
+const apiPath = "/api/v4"
+
+// normalizeBaseURL accepts a bare hostname (https:// is assumed) or a host
+// root (/api/v4 is added), drops trailing slashes, and rejects anything
+// that cannot be an API URL.
+func normalizeBaseURL(raw string) (string, error) {
+	s := raw
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+	u, err := neturl.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("PASSWORK_BASE_URL %q is not a valid URL", raw)
+	}
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https":
+		return "", fmt.Errorf("PASSWORK_BASE_URL %q: scheme must be http or https", raw)
+	case u.Host == "" || u.Hostname() == "":
+		return "", fmt.Errorf("PASSWORK_BASE_URL %q has no host", raw)
+	case u.User != nil:
+		return "", fmt.Errorf("PASSWORK_BASE_URL %q must not contain credentials; set PASSWORK_API_KEY instead", raw)
+	case u.RawQuery != "" || u.Fragment != "":
+		return "", fmt.Errorf("PASSWORK_BASE_URL %q must not have a query or fragment", raw)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	if u.Path == "" {
+		u.Path = apiPath
+	}
+	n := u.String()
+	if n != raw {
+		debugf("using base URL %s", n)
+	}
+	return n, nil
+}
+
+func isHeaderToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseHeaders parses PWFZ_HEADERS ("Name: value; Other: value") into a
+// header set. Values are never logged.
+func parseHeaders(spec string) (http.Header, error) {
+	h := http.Header{}
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || !isHeaderToken(name) {
+			return nil, fmt.Errorf("PWFZ_HEADERS: invalid header %q (want \"Name: value\")", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("PWFZ_HEADERS: header %s has a line break in its value", name)
+		}
+		h.Add(name, value)
+		debugf("extra header %s: <redacted>", http.CanonicalHeaderKey(name))
+	}
+	return h, nil
+}
+
+func configFromEnv() (Config, error) {
+	cfgs, err := configsFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+	if len(cfgs) > 1 {
+		return Config{}, errors.New("PASSWORK_BASE_URL lists several instances; only the search command supports that")
+	}
+	return cfgs[0], nil
+}
+
+// configsFromEnv returns one Config per comma-separated PASSWORK_BASE_URL.
+// PASSWORK_API_KEY holds either one key shared by all instances or one key
+// per URL, in the same order. Either falls back to the config file when
+// unset. An explicit -profile or PWFZ_PROFILE reads both from that profile
+// in the config file and ignores the environment. The profile's clipboard
+// and fzf settings are applied too.
+func configsFromEnv() ([]Config, error) {
+	applyProfileSettings()
+	name, explicit := profileName()
+	var baseURL, apiKey, keyCmd string
+	if !explicit {
+		baseURL = trimEnv("PASSWORK_BASE_URL")
+		apiKey = trimEnv("PASSWORK_API_KEY")
+		keyCmd = trimEnv("PWFZ_API_KEY_CMD")
+	}
+	if baseURL == "" || (apiKey == "" && keyCmd == "") {
+		fc, err := loadConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		fp, ok := fc.credentials(name)
+		if !ok {
+			return nil, fmt.Errorf("profile %q is not defined in %s", name, configFilePath())
+		}
+		if baseURL == "" {
+			baseURL = fp.BaseURL
+		}
+		if apiKey == "" && keyCmd == "" {
+			apiKey, keyCmd = fp.APIKey, fp.APIKeyCmd
+		}
+	}
+	if apiKey == "" && keyCmd != "" {
+		key, err := apiKeyFromCommand(keyCmd)
+		if err != nil {
+			return nil, err
+		}
+		apiKey = key
+	}
+	if baseURL == "" {
+		return nil, fmt.Errorf("PASSWORK_BASE_URL is not set (in the environment or %s)", configFilePath())
+	}
+	urls := strings.Split(baseURL, ",")
+	keys := strings.Split(apiKey, ",")
+	if len(keys) != 1 && len(keys) != len(urls) {
+		return nil, fmt.Errorf("PASSWORK_API_KEY lists %d keys for %d base URLs", len(keys), len(urls))
+	}
+
+	var headers http.Header
+	if spec := os.Getenv("PWFZ_HEADERS"); spec != "" {
+		h, err := parseHeaders(spec)
+		if err != nil {
+			return nil, err
+		}
+		headers = h
+	}
+	var pins [][]byte
+	if spec := os.Getenv("PWFZ_PIN_SHA256"); spec != "" {
+		p, err := parsePins(spec)
+		if err != nil {
+			return nil, err
+		}
+		pins = p
+	}
+
+	cfgs := make([]Config, len(urls))
+	for i, u := range urls {
+		key := keys[0]
+		if len(keys) > 1 {
+			key = keys[i]
+		}
+		if len(urls) > 1 {
+			u, key = strings.TrimSpace(u), strings.TrimSpace(key)
+		}
+		if u == "" {
+			return nil, fmt.Errorf("PASSWORK_BASE_URL entry %d is empty", i+1)
+		}
+		u, err := normalizeBaseURL(u)
+		if err != nil {
+			return nil, err
+		}
+		if strings.ContainsAny(key, " \t\r\n") {
+			return nil, errAPIKeyWhitespace
+		}
+		cfgs[i] = Config{BaseURL: u, APIKey: key, Profile: name, Headers: headers, Pins: pins, Insecure: insecure || envBool("PWFZ_INSECURE")}
+	}
+	return cfgs, nil
+}
+
+// fileConfig is the optional JSON config file, read when the environment
+// does not provide a setting. It holds the API key, so like an ssh key it
+// must not be readable by anyone else.
+type fileConfig struct {
+	BaseURL     string                 `json:"base_url"`
+	APIKey      string                 `json:"api_key"`
+	APIKeyCmd   string                 `json:"api_key_cmd"`
+	ConfirmTags []string               `json:"confirm_tags"`
+	Profiles    map[string]fileProfile `json:"profiles"`
+}
+
+// fileProfile is one named account in the config file's "profiles". The
+// clipboard and fzf settings stand in for the environment variable of the
+// same name while it is unset; see applyProfileSettings.
+type fileProfile struct {
+	BaseURL   string `json:"base_url"`
+	APIKey    string `json:"api_key"`
+	APIKeyCmd string `json:"api_key_cmd"`
+
+	ClipBin      string `json:"clip_bin"`      // CLIP_BIN
+	FzfBin       string `json:"fzf_bin"`       // FZF_BIN
+	FzfOpts      string `json:"fzf_opts"`      // PWFZ_FZF_OPTS
+	ClearSeconds *int   `json:"clear_seconds"` // PWFZ_CLEAR_SECONDS
+}
+
+// defaultProfile is used when neither -profile nor PWFZ_PROFILE is set.
+const defaultProfile = "default"
+
+// profileName returns the selected profile and whether it was asked for
+// explicitly.
+func profileName() (string, bool) {
+	if profile != "" {
+		return profile, true
+	}
+	if p := trimEnv("PWFZ_PROFILE"); p != "" {
+		return p, true
+	}
+	return defaultProfile, false
+}
+
+// credentials returns the base URL, API key and API key command of the
+// named profile. The top-level settings act as the default profile when
+// there is no profile called "default".
+func (fc fileConfig) credentials(name string) (fileProfile, bool) {
+	p, found := fc.Profiles[name]
+	if !found {
+		if name != defaultProfile {
+			return fileProfile{}, false
+		}
+		p = fileProfile{BaseURL: fc.BaseURL, APIKey: fc.APIKey, APIKeyCmd: fc.APIKeyCmd}
+	}
+	return fileProfile{
+		BaseURL:   strings.TrimSpace(p.BaseURL),
+		APIKey:    strings.TrimSpace(p.APIKey),
+		APIKeyCmd: strings.TrimSpace(p.APIKeyCmd),
+	}, true
+}
+
+// apiKeyFromCommand runs PWFZ_API_KEY_CMD (or api_key_cmd), e.g.
+// "pass show passwork/api-key", and returns its output as the API key.
+// The command keeps the terminal, so a pinentry prompt still works.
+func apiKeyFromCommand(cmdline string) (string, error) {
+	debugf("reading the API key from a command")
+	cmd := shellCommand(cmdline)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("API key command failed: %w", err)
+	}
+	key := strings.TrimSpace(string(out))
+	if key == "" {
+		return "", errors.New("API key command printed nothing")
+	}
+	return key, nil
+}
+
+// configFilePath is PWFZ_CONFIG, or pwfz/config.json in the user config
+// directory (~/.config on Linux).
+func configFilePath() string {
+	if p := strings.TrimSpace(os.Getenv("PWFZ_CONFIG")); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "pwfz", "config.json")
+}
+
+// loadConfigFile reads the config file once. A missing file is not an
+// error; one with permissions looser than 0600 is.
+var loadConfigFile = sync.OnceValues(func() (fileConfig, error) {
+	var fc fileConfig
+	path := configFilePath()
+	if path == "" {
+		return fc, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fc, nil
+	}
+	if err != nil {
+		return fc, fmt.Errorf("config file: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fc, fmt.Errorf("config file: %w", err)
+	}
+	if perm := fi.Mode().Perm(); runtime.GOOS != "windows" && perm&0o077 != 0 {
+		return fc, fmt.Errorf("config file %s has permissions %04o; it holds the API key, so run chmod 600 on it", path, perm)
+	}
+	if err := json.NewDecoder(f).Decode(&fc); err != nil {
+		return fc, fmt.Errorf("config file %s: %w", path, err)
+	}
+	return fc, nil
+})
+
+// applyProfileSettings copies the selected profile's clipboard and fzf
+// settings into the environment wherever the variable itself is unset, so
+// the environment still wins. Going through the environment means every
+// reader, including the detached clipboard clearer, sees the same value.
+func applyProfileSettings() {
+	name, _ := profileName()
+	fc, err := loadConfigFile()
+	if err != nil {
+		debugf("profile settings not applied: %v", err)
+		return
+	}
+	p, ok := fc.Profiles[name]
+	if !ok {
+		return
+	}
+	settings := map[string]string{
+		"CLIP_BIN":      strings.TrimSpace(p.ClipBin),
+		"FZF_BIN":       strings.TrimSpace(p.FzfBin),
+		"PWFZ_FZF_OPTS": p.FzfOpts,
+	}
+	if p.ClearSeconds != nil {
+		settings["PWFZ_CLEAR_SECONDS"] = strconv.Itoa(*p.ClearSeconds)
+	}
+	for _, env := range slices.Sorted(maps.Keys(settings)) {
+		v := settings[env]
+		if v == "" || os.Getenv(env) != "" {
+			continue
+		}
+		debugf("%s from profile %q", env, name)
+		os.Setenv(env, v)
+	}
+}
+
+// authToken is a session token shared by concurrent requests. withReauth
+// replaces it at most once, so a server that keeps answering 401 cannot
+// cause a login loop.
+type authToken struct {
+	mu      sync.Mutex
+	value   string
+	renewed bool
+}
+
+func (t *authToken) get() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.value
+}
+
+// withReauth runs fn with the current token and, when it fails with a 401,
+// logs in again and runs it once more with the fresh token. Concurrent
+// callers that hit the same stale token share a single login.
+func withReauth(ctx context.Context, cfg Config, client *http.Client, t *authToken, fn func(token string) error) error {
+	stale := t.get()
+	err := fn(stale)
+	if !errors.Is(err, errUnauthorized) {
+		return err
+	}
+
+	t.mu.Lock()
+	if t.value == stale {
+		if t.renewed {
+			t.mu.Unlock()
+			return err
+		}
+		debugf("token rejected, logging in again and retrying once")
+		fresh, lerr := relogin(ctx, cfg, client)
+		if lerr != nil {
+			t.mu.Unlock()
+			return lerr
+		}
+		t.value, t.renewed = fresh, true
+	}
+	fresh := t.value
+	t.mu.Unlock()
+	return fn(fresh)
+}
+
+// searchEntries runs the search, retrying once with a fresh token on a 401
+// and, with -reauth-on-empty, when it comes back empty: some servers answer
+// a stale token with an empty result set instead. *token is updated on
+// re-login. ID-like queries additionally match entries by ID (see
+// idPrefixHits).
+func searchEntries(ctx context.Context, cfg Config, client *http.Client, token *string, query string) ([]passwordSearchHit, error) {
+	search := searchPasswords
+	if strings.TrimSpace(query) == "" {
+		search = browseAll
+	}
+	var hits []passwordSearchHit
+	tok := &authToken{value: *token}
+	err := withReauth(ctx, cfg, client, tok, func(token string) (err error) {
+		hits, err = search(ctx, cfg, client, token, query)
+		return err
+	})
+	*token = tok.get()
+	if err == nil && len(hits) == 0 && reauthOnEmpty {
+		debugf("search returned no hits, logging in again and retrying once")
+		fresh, lerr := relogin(ctx, cfg, client)
+		if lerr != nil {
+			return nil, lerr
+		}
+		*token = fresh
+		hits, err = search(ctx, cfg, client, fresh, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return capHits(mergeHits(idPrefixHits(ctx, cfg, client, token, query, hits), hits)), nil
+}
+
+// capHits applies -limit.
+func capHits(hits []passwordSearchHit) []passwordSearchHit {
+	if searchLimit > 0 && len(hits) > searchLimit {
+		debugf("keeping the first %d of %d hits (-limit)", searchLimit, len(hits))
+		return hits[:searchLimit]
+	}
+	return hits
+}
+
+// Entry IDs are 24 hex digits (MongoDB ObjectIDs). Shorter ID references
+// need at least minIDPrefix of them.
+const (
+	idLen       = 24
+	minIDPrefix = 8
+)
+
+// looksLikeIDPrefix reports whether a query could be (the start of) an entry
+// ID: minIDPrefix to idLen hex digits, with both a digit and a letter, so
+// words ("deadbeef"), numbers and dates ("20241015") don't qualify.
+func looksLikeIDPrefix(q string) bool {
+	if len(q) < minIDPrefix || len(q) > idLen {
+		return false
+	}
+	digit, letter := false, false
+	for _, r := range strings.ToLower(q) {
+		switch {
+		case r >= '0' && r <= '9':
+			digit = true
+		case r >= 'a' && r <= 'f':
+			letter = true
+		default:
+			return false
+		}
+	}
+	return digit && letter
+}
+
+// idPrefixHits resolves ID-like queries without listing the whole server:
+// a full ID is fetched directly, a shorter prefix is matched against the
+// search's own hits and, with PWFZ_CACHE_TTL, the IDs in the detail cache.
+// A failed fetch only drops the ID match; *token is updated on re-login.
+func idPrefixHits(ctx context.Context, cfg Config, client *http.Client, token *string, query string, hits []passwordSearchHit) []passwordSearchHit {
+	if !looksLikeIDPrefix(query) {
+		return nil
+	}
+	if len(query) == idLen {
+		tok := &authToken{value: *token}
+		defer func() { *token = tok.get() }()
+		var d passwordDetail
+		err := withReauth(ctx, cfg, client, tok, func(token string) (err error) {
+			d, err = getPassword(ctx, cfg, client, token, query)
+			return err
+		})
+		if err != nil {
+			debugf("ID lookup failed: %v", err)
+			return nil
+		}
+		debugf("query matches entry ID %s exactly", d.ID)
+		return []passwordSearchHit{{ID: d.ID, Name: d.Name}}
+	}
+
+	prefix := strings.ToLower(query)
+	var out []passwordSearchHit
+	for _, h := range slices.Concat(hits, openDetailCache(cfg).idPrefix(prefix)) {
+		if strings.HasPrefix(strings.ToLower(h.ID), prefix) {
+			out = append(out, h)
+		}
+	}
+	out = dedupeHits(out)
+	debugf("query matches %d entry ID(s) by prefix", len(out))
+	return out
+}
+
+// mergeHits concatenates hit lists, dropping IDs already seen.
+func mergeHits(lists ...[]passwordSearchHit) []passwordSearchHit {
+	return dedupeHits(slices.Concat(lists...))
+}
+
+// dedupeHits drops repeated IDs, keeping the first occurrence in order.
+// Servers may list an entry once per matching field.
+func dedupeHits(hits []passwordSearchHit) []passwordSearchHit {
+	seen := make(map[string]bool, len(hits))
+	out := make([]passwordSearchHit, 0, len(hits))
+	for _, h := range hits {
+		if seen[h.ID] {
+			continue
+		}
+		seen[h.ID] = true
+		out = append(out, h)
+	}
+	return out
+}
+
+// progress renders a single "fetching N/M..." line on stderr. It is safe for
+// concurrent use and does nothing unless stderr is a terminal. With -v the
+// workers log each request, which would tear the line, so it is off too.
+type progress struct {
+	mu      sync.Mutex
+	enabled bool
+	verb    string // "fetching", "importing"
+	done    int
+	total   int
+}
+
+func newProgress(verb string, total int) *progress {
+	return &progress{
+		enabled: !quiet && logLevel == 0 && isTerminal(os.Stderr),
+		verb:    verb,
+		total:   total,
+	}
+}
+
+func (p *progress) inc() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if p.enabled {
+		fmt.Fprintf(os.Stderr, "\r%s %d/%d...", p.verb, p.done, p.total)
+	}
+}
+
+// clear wipes the progress line so later output starts on a clean line.
+func (p *progress) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.enabled && p.done > 0 {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+}
+
+// warnf prints a warning on its own line without racing the progress line.
+func (p *progress) warnf(format string, args ...any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.enabled && p.done > 0 {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+	fmt.Fprintf(os.Stderr, format, args...)
+}
+
+// concurrencyFlag is set by benchmark's -concurrency; 0 means
+// PWFZ_CONCURRENCY.
+var concurrencyFlag int
+
+// fetchConcurrency is how many details fetchDetails requests in parallel.
+func fetchConcurrency() int {
+	if concurrencyFlag > 0 {
+		return concurrencyFlag
+	}
+	return envInt("PWFZ_CONCURRENCY", 8)
+}
+
+// fetchDetails resolves search hits into full entries using up to
+// PWFZ_CONCURRENCY (default 8) parallel requests, started at most PWFZ_RATE
+// per second when that is set. The result keeps the search order, with
+// repeated IDs fetched once; an id that cannot be fetched is kept as a
+// lazily-loaded placeholder, with a warning.
+func fetchDetails(ctx context.Context, cfg Config, client *http.Client, token *string, hits []passwordSearchHit) []passwordDetail {
+	hits = dedupeHits(hits)
+	prog := newProgress("fetching", len(hits))
+	defer prog.clear()
+
+	tok := &authToken{value: *token}
+	defer func() { *token = tok.get() }()
+
+	cache := openDetailCache(cfg)
+	defer cache.save()
+
+	details := make([]passwordDetail, len(hits))
+	var missing []int
+	for i, h := range hits {
+		if d, ok := cache.get(h.ID); ok {
+			details[i] = d
+			prog.inc()
+			continue
+		}
+		missing = append(missing, i)
+	}
+	if len(missing) < len(hits) {
+		debugf("detail cache: %d of %d entries cached", len(hits)-len(missing), len(hits))
+	}
+
+	workers := min(max(fetchConcurrency(), 1), len(missing))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				h := hits[i]
+				var d passwordDetail
+				err := withReauth(ctx, cfg, client, tok, func(token string) (err error) {
+					d, err = getPassword(ctx, cfg, client, token, h.ID)
+					return err
+				})
+				if err != nil {
+					metrics.fetchError()
+					prog.warnf("warning: %s: %v (will load on selection)\n", h.ID, err)
+					// Keep the hit selectable by name; see loadEntry.
+					d = passwordDetail{ID: h.ID, Name: h.Name, lazy: true}
+				} else {
+					cache.put(d)
+				}
+				details[i] = d
+				prog.inc()
+			}
+		}()
+	}
+	// PWFZ_RATE spaces out the fetches across all workers. A ticker drops
+	// ticks nobody waits for, so a slow request never causes a burst.
+	var tick <-chan time.Time
+	if r := envInt("PWFZ_RATE", 0); r > 0 && len(missing) > 1 {
+		t := time.NewTicker(max(time.Second/time.Duration(r), time.Nanosecond))
+		defer t.Stop()
+		tick = t.C
+		debugf("detail fetches limited to %d per second", r)
+	}
+	for n, i := range missing {
+		if tick != nil && n > 0 {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				tick = nil
+			}
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return details
+}
+
+// loadedCount returns how many of details were fetched in full.
+func loadedCount(details []passwordDetail) int {
+	n := 0
+	for _, d := range details {
+		if !d.lazy {
+			n++
+		}
+	}
+	return n
+}
+
+// loadEntry fetches the full details of a lazily-loaded or cached entry in
+// place, keeping its origin.
+func loadEntry(ctx context.Context, cfg Config, client *http.Client, token string, p *passwordDetail) error {
+	if !p.lazy && !p.cached {
+		return nil
+	}
+	var d passwordDetail
+	err := withReauth(ctx, cfg, client, &authToken{value: token}, func(token string) (err error) {
+		d, err = getPassword(ctx, cfg, client, token, p.ID)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("load %q: %w", p.Name, err)
+	}
+	d.src = p.src
+	*p = d
+	return nil
+}
+
+// buildHeader renders the static fzf header so large result sets keep
+// their context: the profile and -vault scope when set, what was searched
+// and how much came back. The default profile is left out.
+func buildHeader(query, profile, vault string, n int) string {
+	var parts []string
+	if profile != "" && profile != defaultProfile {
+		parts = append(parts, "profile: "+profile)
+	}
+	if vault != "" {
+		parts = append(parts, "vault: "+vault)
+	}
+	q := query
+	if q == "" {
+		q = "(all)"
+	}
+	noun := "results"
+	if n == 1 {
+		noun = "result"
+	}
+	parts = append(parts, fmt.Sprintf("query: %s · %d %s", q, n, noun))
+	return strings.Join(parts, " · ")
+}
+
+// selectEntry lets the user pick one of details in fzf. It returns nil
+// without an error when nothing was selected, and the key from expect that
+// accepted the selection ("" for Enter).
+func selectEntry(details []passwordDetail, header string, o *filterOptions, expect ...string) (*passwordDetail, string, error) {
+	chosen, key, err := selectEntries(details, header, o, false, expect...)
+	if err != nil || len(chosen) == 0 {
+		return nil, "", err
+	}
+	return chosen[0], key, nil
+}
+
+// selectEntries is selectEntry for one or, with multi, several entries.
+// Group header lines chosen along with them are skipped.
+func selectEntries(details []passwordDetail, header string, o *filterOptions, multi bool, expect ...string) ([]*passwordDetail, string, error) {
+	lines := make([]string, 0, len(details))
+	prevVault := ""
+	for i, d := range details {
+		if o.groupByVault {
+			if v := vaultName(d); i == 0 || v != prevVault {
+				lines = append(lines, buildGroupHeaderLine(v))
+				prevVault = v
+			}
+		}
+		lines = append(lines, buildFzfLine(d))
+	}
+
+	var extra []string
+	if file, err := writePreviewFile(details); err != nil {
+		debugf("preview disabled: %v", err)
+	} else {
+		defer os.Remove(file)
+		if extra, err = previewArgs(file); err != nil {
+			debugf("preview disabled: %v", err)
+		}
+	}
+
+	if o.fzfQuery != "" {
+		extra = append(extra, "--query="+encodeOutput(o.fzfQuery))
+	}
+	if multi {
+		extra = append(extra, "--multi")
+	}
+	key, selected, err := selectLine(lines, header, extra, expect...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var chosen []*passwordDetail
+	for _, line := range selected {
+		// first field (before \t) is id
+		id := strings.SplitN(line, "\t", 2)[0]
+		if id == groupHeaderID {
+			continue
+		}
+		i := slices.IndexFunc(details, func(d passwordDetail) bool { return fzfKey(d) == id })
+		if i < 0 {
+			return nil, "", fmt.Errorf("could not find password for selected id %s", id)
+		}
+		chosen = append(chosen, &details[i])
+	}
+	return chosen, key, nil
+}
+
+// saveAttachment lets the user pick one of p's attachments (directly when
+// there is only one) and writes it to PWFZ_DOWNLOAD_DIR, or the current
+// directory, without overwriting existing files.
+func saveAttachment(ctx context.Context, in *instance, p passwordDetail) error {
+	if len(p.Attachments) == 0 {
+		fmt.Fprintf(os.Stderr, "entry %q has no attachments\n", p.Name)
+		return nil
+	}
+	att := p.Attachments[0]
+	if len(p.Attachments) > 1 {
+		lines := make([]string, len(p.Attachments))
+		for i, a := range p.Attachments {
+			lines[i] = fmt.Sprintf("%d\t%s", i, orDash(a.Name))
+		}
+		_, selected, err := selectLine(lines, fmt.Sprintf("attachments of %s", p.Name), nil)
+		if err != nil {
+			return err
+		}
+		if len(selected) == 0 {
+			return nil
+		}
+		i, err := strconv.Atoi(strings.SplitN(selected[0], "\t", 2)[0])
+		if err != nil || i < 0 || i >= len(p.Attachments) {
+			return fmt.Errorf("could not find selected attachment %q", selected[0])
+		}
+		att = p.Attachments[i]
+	}
+
+	data, name, err := getAttachment(ctx, in.cfg, in.client, in.token, p.ID, att.ID)
+	if err != nil {
+		return err
+	}
+	if att.Name != "" {
+		name = att.Name
+	}
+	path, err := createUnique(os.Getenv("PWFZ_DOWNLOAD_DIR"), name, data)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Saved attachment %q of %q to %s.\n", name, p.Name, path)
+	return nil
+}
+
+// createUnique writes data to dir/name, adding " (1)", " (2)", ... before
+// the extension instead of replacing an existing file. Only the base of
+// name is used, so a server-supplied name cannot escape dir.
+func createUnique(dir, name string, data []byte) (string, error) {
+	base := filepath.Base(filepath.Clean("/" + name))
+	if base == "/" || base == "." {
+		base = "attachment"
+	}
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	for n := 0; n < 100; n++ {
+		candidate := base
+		if n > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", stem, n, ext)
+		}
+		path := filepath.Join(dir, candidate)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return "", err
+		}
+		return path, f.Close()
+	}
+	return "", fmt.Errorf("too many files named like %q in %s", base, dir)
+}
+
+// listEntries prints the fzf line of every entry for -list, with the ID
+// column only under -v. Colors are kept only when stdout is a terminal.
+func listEntries(details []passwordDetail) {
+	color := isTerminal(os.Stdout)
+	for _, d := range details {
+		id, display, _ := strings.Cut(buildFzfLine(d), "\t")
+		if !color {
+			display = stripANSI(display)
+		}
+		if logLevel >= 1 {
+			fmt.Fprintf(stdout, "%s\t%s\n", id, display)
+		} else {
+			fmt.Fprintln(stdout, display)
+		}
+	}
+}
+
+// firstEntry implements -first: it takes details[0] without asking, but
+// lists the other candidates on stderr when the match was ambiguous.
+func firstEntry(details []passwordDetail) *passwordDetail {
+	if len(details) > 1 {
+		warnf("-first: %d entries match, using the first:", len(details))
+		for i, d := range details {
+			marker := " "
+			if i == 0 {
+				marker = "*"
+			}
+			fmt.Fprintf(os.Stderr, "%s %s | %s (%s)\n", marker, orEmpty(d.Name), orDash(formatPath(d.Path)), fzfKey(d))
+		}
+	}
+	return &details[0]
+}
+
+var (
+	logLevel        int // 0 by default, 1 with -v, 2 with -vv
+	insecure        bool
+	profile         string
+	quiet           bool
+	reauthOnEmpty   bool
+	includeArchived bool
+	searchLimit     int
+)
+
+func addCommonFlags(fs *flag.FlagSet) {
+	fs.BoolFunc("v", "verbose diagnostics on stderr: requests, hit counts and phase timings", func(string) error {
+		logLevel = max(logLevel, 1)
+		return nil
+	})
+	fs.BoolFunc("vv", "like -v, plus request and response headers (values redacted)", func(string) error {
+		logLevel = 2
+		return nil
+	})
+	fs.BoolVar(&quiet, "quiet", false, "suppress progress output")
+	fs.BoolVar(&quiet, "q", false, "shorthand for -quiet")
+	fs.BoolVar(&reauthOnEmpty, "reauth-on-empty", false, "log in again and retry once when a search returns no hits")
+	fs.BoolVar(&includeArchived, "include-archived", false, "also search archived/trashed entries")
+	fs.IntVar(&searchLimit, "limit", 0, "fetch at most `N` search results (0 = all)")
+	fs.StringVar(&profile, "profile", "", "use the named profile from the config file (default: PWFZ_PROFILE, then \"default\")")
+	fs.BoolVar(&insecure, "insecure", false, "skip TLS certificate verification (dangerous; same as PWFZ_INSECURE=1)")
+}
+
+// warnf, debugf and tracef are the stderr diagnostics. Warnings always
+// show; debugf needs -v and tracef -vv. None of them may be given the API
+// key, a token or a secret.
+func warnf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "warning: "+format+"\n", args...)
+}
+
+func debugf(format string, args ...any) {
+	if logLevel >= 1 {
+		fmt.Fprintf(os.Stderr, "debug: "+format+"\n", args...)
+	}
+}
+
+func tracef(format string, args ...any) {
+	if logLevel >= 2 {
+		fmt.Fprintf(os.Stderr, "trace: "+format+"\n", args...)
+	}
+}
+
+// filterOptions narrows (and optionally orders) the fetched entries before
+// they reach the picker.
+type filterOptions struct {
+	folder       string
+	depth        int
+	stable       bool
+	groupByVault bool
+	vault        string          // -vault, a vault name or ID
+	vaultIDs     map[string]bool // -vault resolved by resolveVault
+	tags         []string        // -tag, repeatable
+	tagAny       bool            // -tag-any: any one of tags instead of all
+	fzfQuery     string          // pre-filled, editable fzf query (the last query)
+}
+
+func addFilterFlags(fs *flag.FlagSet) *filterOptions {
+	o := &filterOptions{}
+	fs.StringVar(&o.folder, "folder", "", "only show entries with a path segment containing `name` (case-insensitive)")
+	fs.IntVar(&o.depth, "depth", 0, "only show entries nested at most `N` path segments deep (0 = any)")
+	fs.BoolVar(&o.stable, "stable", false, "order entries by ID so output is reproducible between runs")
+	fs.BoolVar(&o.groupByVault, "group-by-vault", false, "group entries under a header line per vault")
+	fs.StringVar(&o.vault, "vault", "", "only show entries from the vault with this `name or ID`")
+	fs.Func("tag", "only show entries tagged `tag` (case-insensitive, repeatable: all must match)", func(v string) error {
+		if v = strings.TrimSpace(v); v == "" {
+			return errors.New("empty tag")
+		}
+		o.tags = append(o.tags, v)
+		return nil
+	})
+	fs.BoolVar(&o.tagAny, "tag-any", false, "with several -tag flags, show entries that have any of them")
+	fs.Func("fields", "comma-separated `columns` to show, in order: name, path, login, url, description, tags, vault, id (default name,path,login,url,description,tags)", func(v string) (err error) {
+		lineFields, err = parseFields(v)
+		return err
+	})
+	return o
+}
+
+// matchesTags applies -tag and -tag-any.
+func (o *filterOptions) matchesTags(p passwordDetail) bool {
+	if len(o.tags) == 0 {
+		return true
+	}
+	for _, t := range o.tags {
+		switch has := hasTag(p, t); {
+		case has && o.tagAny:
+			return true
+		case !has && !o.tagAny:
+			return false
+		}
+	}
+	return !o.tagAny
+}
+
+// hasTag reports whether p carries tag, ignoring case and surrounding
+// whitespace.
+func hasTag(p passwordDetail, tag string) bool {
+	tag = strings.TrimSpace(tag)
+	for _, t := range p.Tags {
+		if tag != "" && strings.EqualFold(strings.TrimSpace(t), tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveVault maps -vault to vault IDs on one server: the value itself
+// may be an ID, and vaults with that name (case-insensitive) are looked up.
+// Call it once per server before filterDetails.
+func (o *filterOptions) resolveVault(ctx context.Context, cfg Config, client *http.Client, token string) {
+	if o.vault == "" {
+		return
+	}
+	if o.vaultIDs == nil {
+		o.vaultIDs = map[string]bool{o.vault: true}
+	}
+	vaults, err := cachedVaults(ctx, cfg, client, token)
+	if err != nil {
+		warnf("cannot list vaults, treating -vault %q as an ID: %v", o.vault, err)
+		return
+	}
+	for _, v := range vaults {
+		if strings.EqualFold(v.Name, o.vault) {
+			o.vaultIDs[v.ID] = true
+		}
+	}
+}
+
+func pathContainsSegment(path []pathSegment, name string) bool {
+	needle := strings.ToLower(strings.TrimSpace(name))
+	for _, p := range path {
+		if strings.Contains(strings.ToLower(p.Name), needle) {
+			return true
+		}
+	}
+	return false
+}
+
+func filterDetails(details []passwordDetail, o *filterOptions) []passwordDetail {
+	out := details[:0:0]
+	for _, d := range details {
+		if d.Archived && !includeArchived {
+			continue
+		}
+		if o.depth > 0 && len(d.Path) > o.depth {
+			continue
+		}
+		if o.folder != "" && !pathContainsSegment(d.Path, o.folder) {
+			continue
+		}
+		if o.vault != "" && !o.vaultIDs[d.VaultID] {
+			continue
+		}
+		if !o.matchesTags(d) {
+			continue
+		}
+		out = append(out, d)
+	}
+	if o.stable {
+		sort.SliceStable(out, func(i, j int) bool {
+			return out[i].ID < out[j].ID
+		})
+	}
+	if o.groupByVault {
+		sort.SliceStable(out, func(i, j int) bool {
+			return vaultName(out[i]) < vaultName(out[j])
+		})
+	}
+	return out
+}
+
+// -----------------------------------------------------------------------------
+// subcommands
+// -----------------------------------------------------------------------------
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// pickEntry runs login, search, fetch and the picker for subcommands that act
+// on a single entry. When nothing matches or nothing is chosen it returns a
+// noResults error or errCancelled, so the entry is never nil without an
+// error. The picker is shown even for a single match so the user always sees
+// exactly which entry is affected.
+func pickEntry(ctx context.Context, query string, filters *filterOptions) (Config, *http.Client, string, *passwordDetail, error) {
+	cfg, err := configFromEnv()
+	if err != nil {
+		return Config{}, nil, "", nil, configError(err)
+	}
+	if _, err := chooseSelector(); err != nil {
+		return Config{}, nil, "", nil, configError(err)
+	}
+
+	client := newHTTPClient(cfg)
+	pipeline, cancel, limit := pipelineContext(ctx)
+	defer cancel()
+
+	token, err := login(pipeline, cfg, client)
+	if err != nil {
+		return Config{}, nil, "", nil, fmt.Errorf("login error: %w", timeoutError(err, limit))
+	}
+
+	hits, err := searchEntries(pipeline, cfg, client, &token, query)
+	if err != nil {
+		return Config{}, nil, "", nil, fmt.Errorf("search error: %w", timeoutError(err, limit))
+	}
+	if len(hits) == 0 {
+		return Config{}, nil, "", nil, noResults("no passwords found for query %q", query)
+	}
+
+	filters.resolveVault(pipeline, cfg, client, token)
+	fetched := fetchDetails(pipeline, cfg, client, &token, hits)
+	if filters.needVaultNames() {
+		nameVaults(pipeline, cfg, client, token, fetched)
+	}
+	details := filterDetails(fetched, filters)
+	if err := timeoutError(pipeline.Err(), limit); err != nil {
+		return Config{}, nil, "", nil, err
+	}
+	if len(details) == 0 {
+		return Config{}, nil, "", nil, noResults("no usable password entries")
+	}
+
+	chosen, _, err := selectEntry(details, buildHeader(query, cfg.Profile, filters.vault, len(details)), filters)
+	if err != nil {
+		return Config{}, nil, "", nil, err
+	}
+	if chosen == nil {
+		return Config{}, nil, "", nil, errCancelled
+	}
+	if err := loadEntry(ctx, cfg, client, token, chosen); err != nil {
+		return Config{}, nil, "", nil, err
+	}
+	return cfg, client, token, chosen, nil
+}
+
+// confirmDelete asks the user to retype the entry name before deleting it.
+func confirmDelete(name string) error {
+	fmt.Fprintf(os.Stderr, "About to DELETE %q. This cannot be undone.\n", name)
+	fmt.Fprint(os.Stderr, "Type the entry name to confirm: ")
+	typed, err := readLine(bufio.NewReader(os.Stdin))
+	if err != nil {
+		return fmt.Errorf("read confirmation: %w", err)
+	}
+	if typed != name {
+		return errors.New("confirmation did not match entry name, nothing deleted")
+	}
+	return nil
+}
+
+// requireWritable refuses mutating subcommands under PWFZ_READONLY. It is
+// deliberately env-only so no command-line flag can switch it off.
+func requireWritable(subcommand string) error {
+	if envBool("PWFZ_READONLY") {
+		return configError(fmt.Errorf("pwfz %s: refusing to modify entries because PWFZ_READONLY is set", subcommand))
+	}
+	return nil
+}
+
+// confirmTag returns the first of the entry's tags listed in
+// PWFZ_CONFIRM_TAGS (or confirm_tags in the config file), or "" when the
+// entry needs no confirmation.
+func confirmTag(p passwordDetail) string {
+	var tags []string
+	if spec := os.Getenv("PWFZ_CONFIRM_TAGS"); strings.TrimSpace(spec) != "" {
+		tags = strings.Split(spec, ",")
+	} else if fc, err := loadConfigFile(); err == nil {
+		tags = fc.ConfirmTags
+	}
+	for _, want := range tags {
+		if hasTag(p, want) {
+			return strings.TrimSpace(want)
+		}
+	}
+	return ""
+}
+
+// confirmSensitiveCopy asks for [y/N] before copying from an entry tagged
+// with one of PWFZ_CONFIRM_TAGS. Without a terminal it refuses rather than
+// auto-confirming.
+func confirmSensitiveCopy(p passwordDetail) error {
+	tag := confirmTag(p)
+	if tag == "" {
+		return nil
+	}
+	if !isTerminal(os.Stdin) {
+		return fmt.Errorf("entry %q is tagged %q and needs confirmation, but there is no terminal to ask on", p.Name, tag)
+	}
+	fmt.Fprintf(os.Stderr, "%q is tagged %q. Copy it? [y/N] ", p.Name, tag)
+	answer, err := readLine(bufio.NewReader(os.Stdin))
+	if err != nil {
+		return fmt.Errorf("read confirmation: %w", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return errors.New("not confirmed, nothing copied")
+}
+
+func deleteMain(args []string) error {
+	if err := requireWritable("delete"); err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pwfz delete [-yes] [search query...]")
+		fs.PrintDefaults()
+	}
+	yes := fs.Bool("yes", false, "skip the typed-name confirmation (for scripts)")
+	addCommonFlags(fs)
+	filters := addFilterFlags(fs)
+	flagsDefined(fs)
+	fs.Parse(args)
+	query := strings.Join(fs.Args(), " ")
+
+	ctx := context.Background()
+	cfg, client, token, chosen, err := pickEntry(ctx, query, filters)
+	if err != nil {
+		return err
+	}
+
+	if !*yes {
+		if err := confirmDelete(chosen.Name); err != nil {
+			return err
+		}
+	}
+
+	if err := deletePassword(ctx, cfg, client, token, chosen.ID); err != nil {
+		return fmt.Errorf("delete of %q failed: %w", chosen.Name, err)
+	}
+	if cache := openDetailCache(cfg); cache != nil {
+		cache.forget(chosen.ID)
+		cache.save()
+	}
+	fmt.Fprintf(stdout, "Deleted %q (%s).\n", chosen.Name, chosen.ID)
+	return nil
+}
+
+// entryJSON renders p for -json: the fields as the API sent them, except
+// that custom fields are decoded and the raw cryptedPassword is replaced by
+// the decoded password. The top-level fields named in exclude are left out;
+// an excluded password or custom list is not decoded at all.
+func entryJSON(p passwordDetail, exclude []string) ([]byte, error) {
+	var pw string
+	if !slices.Contains(exclude, "password") {
+		var err error
+		if pw, err = decodePassword(p); err != nil {
+			return nil, err
+		}
+	}
+	if slices.Contains(exclude, "custom") {
+		p.Custom = nil
+	} else {
+		custom := make([]customField, len(p.Custom))
+		for i, c := range p.Custom {
+			custom[i] = customField{Name: decodeB64OrRaw(c.Name), Value: decodeB64OrRaw(c.Value), Type: c.Type}
+		}
+		p.Custom = custom
+	}
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	delete(m, "cryptedPassword")
+	m["password"] = pw
+	for _, name := range exclude {
+		delete(m, name)
+	}
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// parseJSONExclude splits the -json-exclude list and checks each name
+// against the fields -json prints, so a typo cannot leave a field in.
+func parseJSONExclude(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	props := entrySchema()["properties"].(map[string]any)
+	var names []string
+	for name := range strings.SplitSeq(list, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := props[name]; !ok {
+			return nil, fmt.Errorf("-json-exclude: %q is not a field of the JSON output (see pwfz schema)", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// jsonSchema describes t as a JSON Schema fragment, driven by the same json
+// struct tags encoding/json uses, so it cannot drift from the real output.
+func jsonSchema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Struct:
+		props := map[string]any{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = jsonSchema(f.Type)
+		}
+		return map[string]any{"type": "object", "properties": props}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Pointer:
+		return jsonSchema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	}
+	return map[string]any{}
+}
+
+// editDoc is the document pwfz edit opens in the editor: the editable
+// fields of an entry with custom fields decoded. Password is only set with
+// -show-secrets.
+type editDoc struct {
+	Name     string        `json:"name"`
+	Login    string        `json:"login"`
+	URL      string        `json:"url"`
+	Tags     []string      `json:"tags"`
+	Custom   []customField `json:"custom"`
+	Password *string       `json:"password,omitempty"`
+}
+
+// unchangedSecret stands in for the value of a password or TOTP custom
+// field in the editor; leaving it as is keeps the current value.
+const unchangedSecret = "<unchanged>"
+
+func isSecretField(c customField) bool {
+	switch strings.ToLower(c.Type) {
+	case "password", "totp":
+		return true
+	}
+	return false
+}
+
+// newEditDoc builds the editor document for p. Secret values stay out of it
+// unless showSecrets is set.
+func newEditDoc(p passwordDetail, showSecrets bool) (editDoc, error) {
+	d := editDoc{Name: p.Name, Login: p.Login, URL: p.URL, Tags: slices.Clone(p.Tags), Custom: []customField{}}
+	if d.Tags == nil {
+		d.Tags = []string{}
+	}
+	for _, c := range p.Custom {
+		f := customField{Name: decodeB64OrRaw(c.Name), Value: decodeB64OrRaw(c.Value), Type: c.Type}
+		if isSecretField(f) && !showSecrets {
+			f.Value = unchangedSecret
+		}
+		d.Custom = append(d.Custom, f)
+	}
+	if showSecrets {
+		pw, err := decodePassword(p)
+		if err != nil {
+			return editDoc{}, err
+		}
+		d.Password = &pw
+	}
+	return d, nil
+}
+
+// editPatch compares the edited document with the original one and returns
+// the changed fields in the API's encoding, plus their names for the user.
+func editPatch(p passwordDetail, old, edited editDoc) (map[string]any, []string, error) {
+	if strings.TrimSpace(edited.Name) == "" {
+		return nil, nil, errors.New("name must not be empty")
+	}
+	patch := map[string]any{}
+	var changed []string
+	set := func(label, key string, v any) {
+		patch[key] = v
+		changed = append(changed, label)
+	}
+	if edited.Name != old.Name {
+		set("name", "name", edited.Name)
+	}
+	if edited.Login != old.Login {
+		set("login", "login", edited.Login)
+	}
+	if edited.URL != old.URL {
+		set("url", "url", edited.URL)
+	}
+	if edited.Tags == nil {
+		edited.Tags = []string{}
+	}
+	if !slices.Equal(edited.Tags, old.Tags) {
+		set("tags", "tags", edited.Tags)
+	}
+	if !slices.Equal(edited.Custom, old.Custom) {
+		custom, err := customPatch(p, old.Custom, edited.Custom)
+		if err != nil {
+			return nil, nil, err
+		}
+		set("custom", "custom", custom)
+	}
+	if old.Password != nil && edited.Password != nil && *edited.Password != *old.Password {
+		if *edited.Password == "" {
+			return nil, nil, errors.New("password must not be empty")
+		}
+		set("password", "cryptedPassword", base64.StdEncoding.EncodeToString([]byte(*edited.Password)))
+	}
+	return patch, changed, nil
+}
+
+// customPatch builds the custom field list to send for an edited document.
+// Each edited field is matched to the entry field it came from: first an
+// identical field, then the field at the same position, so a rename keeps
+// its hidden value and deleting one field does not shift the others. What
+// did not change is sent back exactly as the API stored it; only new names
+// and values are encoded.
+func customPatch(p passwordDetail, old, edited []customField) ([]customField, error) {
+	from := make([]int, len(edited))
+	used := make([]bool, len(old))
+	for i, f := range edited {
+		from[i] = -1
+		for j, o := range old {
+			if !used[j] && f == o {
+				from[i], used[j] = j, true
+				break
+			}
+		}
+	}
+	for i := range edited {
+		if from[i] < 0 && i < len(old) && !used[i] {
+			from[i], used[i] = i, true
+		}
+	}
+
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	custom := make([]customField, 0, len(edited))
+	for i, f := range edited {
+		j := from[i]
+		if j < 0 {
+			if f.Value == unchangedSecret {
+				return nil, fmt.Errorf("custom field %q: no current value to keep for %s", f.Name, unchangedSecret)
+			}
+			custom = append(custom, customField{Name: encode(f.Name), Value: encode(f.Value), Type: f.Type})
+			continue
+		}
+		c := customField{Name: p.Custom[j].Name, Value: p.Custom[j].Value, Type: f.Type}
+		if f.Name != old[j].Name {
+			c.Name = encode(f.Name)
+		}
+		if f.Value != old[j].Value {
+			if f.Value == unchangedSecret {
+				return nil, fmt.Errorf("custom field %q: no current value to keep for %s", f.Name, unchangedSecret)
+			}
+			c.Value = encode(f.Value)
+		}
+		custom = append(custom, c)
+	}
+	return custom, nil
+}
+
+// editInEditor writes data to a private temp file, opens it in $VISUAL or
+// $EDITOR (vi when neither is set) and returns what was saved. The file is
+// removed afterwards.
+func editInEditor(data []byte) ([]byte, error) {
+	f, err := os.CreateTemp("", "pwfz-edit-*.json")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	editor := trimEnv("VISUAL")
+	if editor == "" {
+		editor = trimEnv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := shellCommand(editor + " " + shellQuote(f.Name()))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("editor %q: %w", editor, err)
+	}
+	return os.ReadFile(f.Name())
+}
+
+// editMain opens the name, login, URL, tags and custom fields of the
+// selected entry in an editor and sends the fields that changed.
+func editMain(args []string) error {
+	if err := requireWritable("edit"); err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pwfz edit [-show-secrets] [search query...]")
+		fs.PrintDefaults()
+	}
+	showSecrets := fs.Bool("show-secrets", false, "also put the password and secret custom field values in the editor")
+	addCommonFlags(fs)
+	filters := addFilterFlags(fs)
+	flagsDefined(fs)
+	fs.Parse(args)
+	query := strings.Join(fs.Args(), " ")
+
+	ctx := context.Background()
+	cfg, client, token, chosen, err := pickEntry(ctx, query, filters)
+	if err != nil {
+		return err
+	}
+	if raw, ok := decodeFlexibleB64(chosen.CryptedPassword); ok && strings.HasPrefix(raw, string(saltedMagic)) {
+		return fmt.Errorf("pwfz edit: %q uses client-side encryption, which pwfz cannot write", chosen.Name)
+	}
+
+	old, err := newEditDoc(*chosen, *showSecrets)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(old); err != nil {
+		return err
+	}
+	saved, err := editInEditor(buf.Bytes())
+	clear(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	defer clear(saved)
+
+	var edited editDoc
+	dec := json.NewDecoder(bytes.NewReader(saved))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&edited); err != nil {
+		return fmt.Errorf("pwfz edit: cannot parse the edited entry, nothing was changed: %w", err)
+	}
+	patch, changed, err := editPatch(*chosen, old, edited)
+	if err != nil {
+		return fmt.Errorf("pwfz edit: %w, nothing was changed", err)
+	}
+	if len(patch) == 0 {
+		fmt.Fprintln(stdout, "No changes.")
+		return nil
+	}
+
+	if err := updatePassword(ctx, cfg, client, token, chosen.ID, patch); err != nil {
+		return fmt.Errorf("update of %q failed: %w", chosen.Name, err)
+	}
+	if cache := openDetailCache(cfg); cache != nil {
+		cache.forget(chosen.ID)
+		cache.save()
+	}
+	fmt.Fprintf(stdout, "Updated %q (%s).\n", chosen.Name, strings.Join(changed, ", "))
+	return nil
+}
+
+// addMain creates an entry from flags, prompting on the terminal for
+// anything missing. The password is read without echo, or from stdin when
+// it is not a terminal, and never from a flag.
+func addMain(args []string) error {
+	if err := requireWritable("add"); err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pwfz add -vault V [-name N] [-login L] [-url U] < password")
+		fs.PrintDefaults()
+	}
+	name := fs.String("name", "", "entry name (prompted for when not given)")
+	entryLogin := fs.String("login", "", "entry login")
+	entryURL := fs.String("url", "", "entry URL")
+	vault := fs.String("vault", "", "vault to create the entry in, by `name or ID` (prompted for when not given)")
+	addCommonFlags(fs)
+	flagsDefined(fs)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return configError(errors.New("pwfz add takes no arguments; use -name"))
+	}
+
+	interactive := isTerminal(os.Stdin)
+	in := bufio.NewReader(os.Stdin)
+	ask := func(v *string, label string) error {
+		if *v != "" || !interactive {
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "%s: ", label)
+		line, err := readLine(in)
+		if err != nil {
+			return err
+		}
+		*v = strings.TrimSpace(line)
+		return nil
+	}
+	for _, q := range []struct {
+		v     *string
+		label string
+	}{{vault, "Vault"}, {name, "Name"}, {entryLogin, "Login"}, {entryURL, "URL"}} {
+		if err := ask(q.v, q.label); err != nil {
+			return err
+		}
+	}
+	if *vault == "" || *name == "" {
+		return configError(errors.New("pwfz add: -vault and -name are required"))
+	}
+
+	cfg, err := configFromEnv()
+	if err != nil {
+		return configError(err)
+	}
+	pw, err := readNewPassword(interactive)
+	if err != nil {
+		return err
+	}
+	defer clear(pw)
+
+	ctx := context.Background()
+	client := newHTTPClient(cfg)
+	token, err := login(ctx, cfg, client)
+	if err != nil {
+		return fmt.Errorf("login error: %w", err)
+	}
+
+	id, err := createPassword(ctx, cfg, client, token, passwordInput{
+		VaultID:         vaultIDFor(ctx, cfg, client, token, *vault),
+		Name:            *name,
+		Login:           *entryLogin,
+		URL:             *entryURL,
+		CryptedPassword: base64.StdEncoding.EncodeToString(pw),
+	})
+	if err != nil {
+		return fmt.Errorf("create of %q failed: %w", *name, err)
+	}
+	fmt.Fprintln(stdout, id)
+	return nil
+}
+
+// vaultIDFor maps a vault name (case-insensitive) to its ID for the write
+// subcommands. Anything else, or every value when the vault list cannot be
+// fetched, is taken to be an ID already.
+func vaultIDFor(ctx context.Context, cfg Config, client *http.Client, token, vault string) string {
+	vaults, err := cachedVaults(ctx, cfg, client, token)
+	if err != nil {
+		warnf("cannot list vaults, treating -vault %q as an ID: %v", vault, err)
+		return vault
+	}
+	for _, v := range vaults {
+		if strings.EqualFold(v.Name, vault) {
+			return v.ID
+		}
+	}
+	return vault
+}
+
+// readNewPassword reads the password for pwfz add: twice without echo on a
+// terminal, otherwise all of stdin minus one trailing newline.
+func readNewPassword(interactive bool) ([]byte, error) {
+	if !interactive {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("read password: %w", err)
+		}
+		b = bytes.TrimSuffix(bytes.TrimSuffix(b, []byte("\n")), []byte("\r"))
+		if len(b) == 0 {
+			return nil, errors.New("pwfz add: empty password on stdin")
+		}
+		return b, nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	pw, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("read password: %w", err)
+	}
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	again, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	defer clear(again)
+	if err != nil {
+		clear(pw)
+		return nil, fmt.Errorf("read password: %w", err)
+	}
+	if !bytes.Equal(pw, again) || len(pw) == 0 {
+		clear(pw)
+		return nil, errors.New("pwfz add: passwords are empty or do not match")
+	}
+	return pw, nil
+}
+
+// importColumns maps the header names of common CSV exports (pwfz's own
+// name,login,url,password,notes, KeePass, KeePassXC, browsers) to the
+// columns pwfz import reads.
+var importColumns = map[string]string{
+	"name": "name", "title": "name", "account": "name",
+	"login": "login", "username": "login", "user name": "login", "login name": "login",
+	"url": "url", "web site": "url", "website": "url",
+	"password": "password", "notes": "notes", "comments": "notes", "description": "notes",
+}
+
+// importOrder is the column order of a CSV file without a header row.
+var importOrder = []string{"name", "login", "url", "password", "notes"}
+
+// importHeader returns the columns named by a header row, or nil when rec
+// has no password column and so is not a header.
+func importHeader(rec []string) map[string]int {
+	cols := map[string]int{}
+	for i, name := range rec {
+		if c, ok := importColumns[strings.ToLower(strings.TrimSpace(name))]; ok {
+			if _, dup := cols[c]; !dup {
+				cols[c] = i
+			}
+		}
+	}
+	if _, ok := cols["password"]; !ok {
+		return nil
+	}
+	return cols
+}
+
+// importRow is one entry read by pwfz import, with the line it starts on
+// for messages.
+type importRow struct {
+	line int
+	in   passwordInput
+}
+
+// readImportCSV reads the rows of a CSV export. A first row that names a
+// password column is taken as the header; otherwise the columns are
+// importOrder. Rows without a name or password are returned as problems
+// rather than rows, so one bad row does not stop the others.
+func readImportCSV(r io.Reader) (rows []importRow, problems []string, err error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	var cols map[string]int
+	for n := 0; ; n++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		if n == 0 {
+			rec[0] = strings.TrimPrefix(rec[0], "\ufeff")
+			if cols = importHeader(rec); cols != nil {
+				continue
+			}
+			cols = map[string]int{}
+			for i, c := range importOrder {
+				cols[c] = i
+			}
+		}
+		if len(rec) == 1 && strings.TrimSpace(rec[0]) == "" {
+			continue
+		}
+		field := func(c string) string {
+			if i, ok := cols[c]; ok && i < len(rec) {
+				return rec[i]
+			}
+			return ""
+		}
+		row := importRow{line: line, in: passwordInput{
+			Name:            strings.TrimSpace(field("name")),
+			Login:           strings.TrimSpace(field("login")),
+			URL:             strings.TrimSpace(field("url")),
+			Description:     field("notes"),
+			CryptedPassword: field("password"),
+		}}
+		switch {
+		case row.in.Name == "":
+			problems = append(problems, fmt.Sprintf("line %d: no name", line))
+		case row.in.CryptedPassword == "":
+			problems = append(problems, fmt.Sprintf("line %d (%s): no password", line, row.in.Name))
+		default:
+			rows = append(rows, row)
+		}
+	}
+	if cols == nil {
+		return nil, nil, errors.New("the file has no rows")
+	}
+	return rows, problems, nil
+}
+
+// importMain creates an entry for every row of a CSV export. Rows that
+// cannot be read or created are listed at the end; the others are still
+// created. Nothing is written without -yes, and -dry-run only checks the
+// file.
+func importMain(args []string) error {
+	if err := requireWritable("import"); err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pwfz import -in FILE -vault V [-yes | -dry-run]")
+		fs.PrintDefaults()
+	}
+	file := fs.String("in", "", "CSV `file` to import: name,login,url,password,notes, or a header row naming the columns (- for stdin)")
+	vault := fs.String("vault", "", "vault to create the entries in, by `name or ID`")
+	yes := fs.Bool("yes", false, "create the entries; required because this writes many entries at once")
+	dryRun := fs.Bool("dry-run", false, "only check the file; nothing is created and the server is not contacted")
+	addCommonFlags(fs)
+	flagsDefined(fs)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return configError(errors.New("pwfz import takes no arguments; use -in"))
+	}
+	if *file == "" || *vault == "" {
+		return configError(errors.New("pwfz import: -in and -vault are required"))
+	}
+
+	f := os.Stdin
+	if *file != "-" {
+		var err error
+		if f, err = os.Open(*file); err != nil {
+			return fmt.Errorf("pwfz import: %w", err)
+		}
+		defer f.Close()
+	}
+	rows, problems, err := readImportCSV(f)
+	if err != nil {
+		return fmt.Errorf("pwfz import: %s: %w", *file, err)
+	}
+	total := len(rows) + len(problems)
+
+	if *dryRun {
+		fmt.Fprintf(stdout, "%d of %d rows can be imported into %q.\n", len(rows), total, *vault)
+		return importProblems(problems, total)
+	}
+	if !*yes {
+		return configError(fmt.Errorf("pwfz import: this creates %d entries in %q; pass -yes to go ahead, or -dry-run to only check the file", len(rows), *vault))
+	}
+	if len(rows) == 0 {
+		return importProblems(problems, total)
+	}
+
+	cfg, err := configFromEnv()
+	if err != nil {
+		return configError(err)
+	}
+	ctx := context.Background()
+	client := newHTTPClient(cfg)
+	token, err := login(ctx, cfg, client)
+	if err != nil {
+		return fmt.Errorf("login error: %w", err)
+	}
+	vaultID := vaultIDFor(ctx, cfg, client, token, *vault)
+
+	// Entries are created one at a time, in file order, and never retried,
+	// so a gateway error cannot create an entry twice.
+	tok := &authToken{value: token}
+	prog := newProgress("importing", len(rows))
+	created := 0
+	for _, row := range rows {
+		in := row.in
+		in.VaultID = vaultID
+		pw := []byte(in.CryptedPassword)
+		in.CryptedPassword = base64.StdEncoding.EncodeToString(pw)
+		clear(pw)
+		var id string
+		err := withReauth(ctx, cfg, client, tok, func(token string) (err error) {
+			id, err = createPassword(ctx, cfg, client, token, in)
+			return err
+		})
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("line %d (%s): %v", row.line, in.Name, err))
+		} else {
+			created++
+			debugf("line %d: created %q as %s", row.line, in.Name, id)
+		}
+		prog.inc()
+	}
+	prog.clear()
+	fmt.Fprintf(stdout, "Imported %d of %d rows into %q.\n", created, total, *vault)
+	return importProblems(problems, total)
+}
+
+// importProblems lists the rows pwfz import skipped on stderr and fails
+// when there were any.
+func importProblems(problems []string, total int) error {
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, "  "+p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("pwfz import: %d of %d rows were not imported", len(problems), total)
+	}
+	return nil
+}
+
+func historyMain(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pwfz history [flags] [search query...]")
+		fs.PrintDefaults()
+	}
+	addCommonFlags(fs)
+	filters := addFilterFlags(fs)
+	flagsDefined(fs)
+	fs.Parse(args)
+	query := strings.Join(fs.Args(), " ")
+
+	ctx := context.Background()
+	cfg, client, token, chosen, err := pickEntry(ctx, query, filters)
+	if err != nil {
+		return err
+	}
+
+	events, err := getPasswordHistory(ctx, cfg, client, token, chosen.ID)
+	if errors.Is(err, errHistoryUnsupported) {
+		return errors.New("this Passwork server does not expose entry history")
+	}
+	if err != nil {
+		return fmt.Errorf("history error: %w", err)
+	}
+	if len(events) == 0 {
+		fmt.Fprintf(stdout, "No recorded history for %q.\n", chosen.Name)
+		return nil
+	}
+
+	fmt.Fprintf(stdout, "History for %q:\n", chosen.Name)
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "WHEN\tWHO\tACTION")
+	for _, e := range events {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", orDash(e.when()), orDash(e.who()), orDash(e.Action))
+	}
+	return tw.Flush()
+}
+
+// durationStats summarizes a set of timings.
+type durationStats struct {
+	Min, Max, Mean, P95 time.Duration
+}
+
+// MarshalJSON reports the stats in (fractional) milliseconds.
+func (s durationStats) MarshalJSON() ([]byte, error) {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return json.Marshal(map[string]float64{
+		"min_ms":  ms(s.Min),
+		"max_ms":  ms(s.Max),
+		"mean_ms": ms(s.Mean),
+		"p95_ms":  ms(s.P95),
+	})
+}
+
+func computeStats(samples []time.Duration) durationStats {
+	if len(samples) == 0 {
+		return durationStats{}
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+	// nearest-rank percentile
+	idx := (95*len(sorted)+99)/100 - 1
+	return durationStats{
+		Min:  sorted[0],
+		Max:  sorted[len(sorted)-1],
+		Mean: sum / time.Duration(len(sorted)),
+		P95:  sorted[idx],
+	}
+}
+
+func benchmarkMain(args []string) error {
+	fs := flag.NewFlagSet("benchmark", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pwfz benchmark [-runs N] [-concurrency N] [-json] [search query...]")
+		fs.PrintDefaults()
+	}
+	addCommonFlags(fs)
+	runs := fs.Int("runs", 5, "number of search+fetch rounds")
+	fs.IntVar(&concurrencyFlag, "concurrency", envInt("PWFZ_CONCURRENCY", 8), "parallel detail fetches per round (default from PWFZ_CONCURRENCY)")
+	asJSON := fs.Bool("json", false, "print the stats as JSON")
+	flagsDefined(fs)
+	fs.Parse(args)
+	detailCacheOff = true
+	query := strings.Join(fs.Args(), " ")
+	if *runs < 1 {
+		return configError(errors.New("-runs must be at least 1"))
+	}
+	if concurrencyFlag < 1 {
+		return configError(errors.New("-concurrency must be at least 1"))
+	}
+
+	cfg, err := configFromEnv()
+	if err != nil {
+		return configError(err)
+	}
+
+	ctx := context.Background()
+	client := newHTTPClient(cfg)
+
+	token, err := login(ctx, cfg, client)
+	if err != nil {
+		return fmt.Errorf("login error: %w", err)
+	}
+
+	var searchTimes, fetchTimes, totalTimes []time.Duration
+	entries := 0
+	for i := 0; i < *runs; i++ {
+		start := time.Now()
+		hits, err := searchEntries(ctx, cfg, client, &token, query)
+		if err != nil {
+			return fmt.Errorf("search error: %w", err)
+		}
+		searched := time.Now()
+		details := fetchDetails(ctx, cfg, client, &token, hits)
+		done := time.Now()
+
+		searchTimes = append(searchTimes, searched.Sub(start))
+		fetchTimes = append(fetchTimes, done.Sub(searched))
+		totalTimes = append(totalTimes, done.Sub(start))
+		entries = loadedCount(details)
+		debugf("run %d: %d hits, %d entries in %s", i+1, len(hits), entries, done.Sub(start))
+	}
+
+	phases := []struct {
+		Name  string        `json:"phase"`
+		Stats durationStats `json:"stats"`
+	}{
+		{"search", computeStats(searchTimes)},
+		{"fetch", computeStats(fetchTimes)},
+		{"total", computeStats(totalTimes)},
+	}
+
+	if *asJSON {
+		out, err := json.MarshalIndent(map[string]any{
+			"query":       query,
+			"runs":        *runs,
+			"concurrency": concurrencyFlag,
+			"entries":     entries,
+			"phases":      phases,
+		}, "", "  ")
+		if err != nil {
+			return fmt.Errorf("benchmark error: %w", err)
+		}
+		return writeJSON(out)
+	}
+
+	fmt.Fprintf(stdout, "%d runs, %d entries per run, concurrency %d\n", *runs, entries, concurrencyFlag)
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "PHASE\tMIN\tMAX\tMEAN\tP95\t")
+	for _, p := range phases {
+		r := func(d time.Duration) time.Duration { return d.Round(10 * time.Microsecond) }
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t\n", p.Name, r(p.Stats.Min), r(p.Stats.Max), r(p.Stats.Mean), r(p.Stats.P95))
+	}
+	return tw.Flush()
+}
+
+// entrySchema describes what -json prints: see entryJSON.
+func entrySchema() map[string]any {
+	schema := jsonSchema(reflect.TypeOf(passwordDetail{}))
+	props := schema["properties"].(map[string]any)
+	delete(props, "cryptedPassword")
+	props["password"] = map[string]any{"type": "string"}
+	return schema
+}
+
+func schemaMain(args []string) error {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pwfz schema")
+	}
+	flagsDefined(fs)
+	fs.Parse(args)
+
+	schema := entrySchema()
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "pwfz entry"
+
+	out, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return fmt.Errorf("schema error: %w", err)
+	}
+	return writeJSON(out)
+}
+
+// -----------------------------------------------------------------------------
+// argv hygiene
+// -----------------------------------------------------------------------------
+
+// Command lines are visible to every local user via ps, so secrets must
+// reach pwfz through the environment, stdin, a file or a descriptor. argv
+// carries only queries, IDs and options.
+
+// secretFlagWords are name fragments that mark a flag as secret-bearing.
+var secretFlagWords = []string{"password", "passwd", "secret", "token", "api-key", "apikey", "credential"}
+
+// secretFlags returns the value-taking flags of fs whose names suggest they
+// carry a secret. Boolean switches such as -copy-password-and-totp are
+// fine: they select behavior, they do not hold the secret. The test suite
+// runs it over every subcommand's flags through flagsDefined.
+func secretFlags(fs *flag.FlagSet) []string {
+	var bad []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			return
+		}
+		for _, w := range secretFlagWords {
+			if strings.Contains(f.Name, w) {
+				bad = append(bad, f.Name)
+				return
+			}
+		}
+	})
+	return bad
+}
+
+// flagsDefined is called by every subcommand once its flags are defined,
+// before parsing. It does nothing at run time; tests hook it to reach the
+// flag sets.
+var flagsDefined = func(*flag.FlagSet) {}
+
+// checkArgvSecrets refuses a command line that contains the API key, e.g.
+// when it was pasted as the query by mistake. where says where args came
+// from: runArgs checks argv as ps shows it, then again after @file
+// expansion, so a key saved in an argument file is refused too.
+func checkArgvSecrets(args []string, where string) error {
+	keys := os.Getenv("PASSWORK_API_KEY")
+	if fc, err := loadConfigFile(); err == nil {
+		keys += "," + fc.APIKey
+		for _, p := range fc.Profiles {
+			keys += "," + p.APIKey
+		}
+	}
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		if len(key) < 8 {
+			continue
+		}
+		for _, a := range args {
+			if strings.Contains(a, key) {
+				return fmt.Errorf("the Passwork API key appears %s; pass it only via PASSWORK_API_KEY", where)
+			}
+		}
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+// argument files
+// -----------------------------------------------------------------------------
+
+const (
+	maxArgFileBytes = 64 << 10
+	maxArgFileDepth = 8
+)
+
+// expandArgFiles replaces every "@path" argument with the lines of that file
+// (one argument per line, blank lines and "#" comments skipped). Files may
+// reference further at-files; cycles and runaway nesting are rejected. "@@x"
+// stands for a literal "@x", and nothing after a "--" is expanded.
+func expandArgFiles(args []string) ([]string, error) {
+	var literal bool
+	return expandArgFilesDepth(args, map[string]bool{}, 0, &literal)
+}
+
+// expandArgFilesDepth does the work of expandArgFiles. literal is shared by
+// all levels, so a "--" inside an argument file also ends expansion of the
+// arguments that follow the file.
+func expandArgFilesDepth(args []string, seen map[string]bool, depth int, literal *bool) ([]string, error) {
+	out := make([]string, 0, len(args))
+	for _, a := range args {
+		if *literal || len(a) < 2 || a[0] != '@' {
+			if a == "--" {
+				*literal = true
+			}
+			out = append(out, a)
+			continue
+		}
+		if a[1] == '@' {
+			out = append(out, a[1:])
+			continue
+		}
+		path := a[1:]
+		if depth >= maxArgFileDepth {
+			return nil, fmt.Errorf("argument file %s: nested too deeply", path)
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		if seen[abs] {
+			return nil, fmt.Errorf("argument file %s: recursive reference", path)
+		}
+
+		f, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("argument file: %w (write @%s for a literal %s)", err, a, a)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("argument file: %w", err)
+		}
+		data, err := io.ReadAll(io.LimitReader(f, maxArgFileBytes+1))
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("argument file %s: %w", path, err)
+		}
+		if len(data) > maxArgFileBytes {
+			return nil, fmt.Errorf("argument file %s: larger than %d bytes", path, maxArgFileBytes)
+		}
+
+		var lines []string
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			lines = append(lines, line)
+		}
+
+		seen[abs] = true
+		expanded, err := expandArgFilesDepth(lines, seen, depth+1, literal)
+		delete(seen, abs)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, expanded...)
+	}
+	return out, nil
+}
+
+// -----------------------------------------------------------------------------
+// token cache
+// -----------------------------------------------------------------------------
+
+type cachedToken struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// tokenCachePath returns the cache file for cfg. The base URL and API key
+// are hashed into the name so accounts never share a file and the key is
+// not written to disk. PWFZ_TOKEN_TTL=0 disables the cache.
+func tokenCachePath(cfg Config) (string, bool) {
+	if envInt("PWFZ_TOKEN_TTL", defaultTokenTTL) <= 0 {
+		return "", false
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		debugf("no cache dir, token cache disabled: %v", err)
+		return "", false
+	}
+	return filepath.Join(dir, "pwfz", "token-"+accountHash(cfg)+".json"), true
+}
+
+// accountHash names per-account cache files without writing the API key.
+// The profile is part of it so profiles never share a cache.
+func accountHash(cfg Config) string {
+	sum := sha256.Sum256([]byte(cfg.Profile + "\x00" + cfg.BaseURL + "\x00" + cfg.APIKey))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// defaultTokenTTL is how long (in seconds) a cached token is trusted when
+// the server does not say when it expires.
+const defaultTokenTTL = 600
+
+func loadCachedToken(cfg Config) (string, bool) {
+	path, ok := tokenCachePath(cfg)
+	if !ok {
+		return "", false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	var c cachedToken
+	if err := json.Unmarshal(data, &c); err != nil || c.Token == "" {
+		debugf("ignoring unreadable token cache %s", path)
+		return "", false
+	}
+	// A little slack so the token does not expire mid-run.
+	if time.Now().Add(30 * time.Second).After(c.Expires) {
+		return "", false
+	}
+	return c.Token, true
+}
+
+func saveCachedToken(cfg Config, token string, expires time.Time) {
+	path, ok := tokenCachePath(cfg)
+	if !ok {
+		return
+	}
+	ttl := time.Duration(envInt("PWFZ_TOKEN_TTL", defaultTokenTTL)) * time.Second
+	if limit := time.Now().Add(ttl); expires.IsZero() || expires.After(limit) {
+		expires = limit
+	}
+	data, err := json.Marshal(cachedToken{Token: token, Expires: expires})
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		debugf("token cache: %v", err)
+		return
+	}
+	if err := writeFileAtomic(path, data, 0o600); err != nil {
+		debugf("token cache: %v", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// detail cache
+// -----------------------------------------------------------------------------
+
+// detailCacheOff lets benchmark measure real fetches; detailCacheRefresh
+// makes sync fetch every entry again and store the result.
+var detailCacheOff, detailCacheRefresh bool
+
+type cachedDetail struct {
+	Fetched time.Time      `json:"fetched"`
+	Detail  passwordDetail `json:"detail"`
+}
+
+// detailCache keeps entry details between runs for PWFZ_CACHE_TTL, so a
+// repeated search skips the per-entry GETs. Secrets are stripped before
+// anything is stored; see cacheable.
+type detailCache struct {
+	path    string
+	ttl     time.Duration
+	refresh bool
+	mu      sync.Mutex
+	entries map[string]cachedDetail
+	dirty   bool
+}
+
+// openDetailCache returns the cache for cfg, or nil when PWFZ_CACHE_TTL
+// is unset or 0.
+func openDetailCache(cfg Config) *detailCache {
+	ttl := envDuration("PWFZ_CACHE_TTL", 0)
+	if ttl <= 0 || detailCacheOff {
+		return nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		debugf("no cache dir, detail cache disabled: %v", err)
+		return nil
+	}
+	c := &detailCache{
+		path:    filepath.Join(dir, "pwfz", "details-"+accountHash(cfg)+".json"),
+		ttl:     ttl,
+		refresh: detailCacheRefresh,
+		entries: map[string]cachedDetail{},
+	}
+	if data, err := os.ReadFile(c.path); err == nil {
+		if err := json.Unmarshal(data, &c.entries); err != nil {
+			debugf("ignoring unreadable detail cache %s", c.path)
+			c.entries = map[string]cachedDetail{}
+		}
+	}
+	return c
+}
+
+func (c *detailCache) get(id string) (passwordDetail, bool) {
+	if c == nil || c.refresh {
+		return passwordDetail{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[id]
+	if !ok || time.Since(e.Fetched) > c.ttl {
+		return passwordDetail{}, false
+	}
+	e.Detail.cached = true
+	return e.Detail, true
+}
+
+func (c *detailCache) put(d passwordDetail) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[d.ID] = cachedDetail{Fetched: time.Now(), Detail: cacheable(d)}
+	c.dirty = true
+}
+
+func (c *detailCache) forget(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[id]; ok {
+		delete(c.entries, id)
+		c.dirty = true
+	}
+}
+
+// idPrefix returns the fresh cached entries whose ID starts with prefix
+// (lower case), ordered by ID.
+func (c *detailCache) idPrefix(prefix string) []passwordSearchHit {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []passwordSearchHit
+	for _, id := range slices.Sorted(maps.Keys(c.entries)) {
+		e := c.entries[id]
+		if strings.HasPrefix(strings.ToLower(id), prefix) && time.Since(e.Fetched) <= c.ttl {
+			out = append(out, passwordSearchHit{ID: id, Name: e.Detail.Name})
+		}
+	}
+	return out
+}
+
+// save writes the cache back, dropping expired entries. Failures only
+// show up with -v.
+func (c *detailCache) save() {
+	if c == nil || !c.dirty {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	maps.DeleteFunc(c.entries, func(_ string, e cachedDetail) bool {
+		return time.Since(e.Fetched) > c.ttl
+	})
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o700); err != nil {
+		debugf("detail cache: %v", err)
+		return
+	}
+	if err := writeFileAtomic(c.path, data, 0o600); err != nil {
+		debugf("detail cache: %v", err)
+	}
+}
+
+// cacheable strips what must not reach the disk: the password and the
+// values of password and TOTP custom fields. A cached entry is therefore
+// re-fetched by loadEntry once it is selected.
+func cacheable(d passwordDetail) passwordDetail {
+	d.CryptedPassword = ""
+	d.Custom = slices.Clone(d.Custom)
+	for i, c := range d.Custom {
+		switch strings.ToLower(c.Type) {
+		case "password", "totp":
+			d.Custom[i].Value = ""
+		}
+	}
+	return d
+}
+
+// syncMain implements "pwfz sync": it fetches every entry the API key can
+// see and stores the details in the cache, so that later searches skip the
+// per-entry requests. Meant for cron or a shell startup file.
+func syncMain(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pwfz sync [flags]")
+		fs.PrintDefaults()
+	}
+	addCommonFlags(fs)
+	flagsDefined(fs)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return configError(errors.New("pwfz sync takes no query"))
+	}
+	if envDuration("PWFZ_CACHE_TTL", 0) <= 0 {
+		return configError(errors.New("pwfz sync needs the detail cache; set PWFZ_CACHE_TTL, e.g. to 1h"))
+	}
+	cfgs, err := configsFromEnv()
+	if err != nil {
+		return configError(err)
+	}
+	detailCacheRefresh = true
+
+	ctx := context.Background()
+	cached, failed := 0, 0
+	for _, in := range newInstances(cfgs) {
+		details, err := in.collect(ctx, "")
+		if err != nil {
+			return fmt.Errorf("%s%w", in.logPrefix(), err)
+		}
+		n := loadedCount(details)
+		cached += n
+		failed += len(details) - n
+	}
+	fmt.Fprintf(stdout, "Cached %d entries.\n", cached)
+	if failed > 0 {
+		return fmt.Errorf("%d entries could not be fetched", failed)
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+// query history & shell completion
+// -----------------------------------------------------------------------------
+
+// maxHistory caps the query history file; older queries are dropped first.
+const maxHistory = 200
+
+// completeCommand is the hidden subcommand completion scripts call to list
+// recent queries, newest first.
+const completeCommand = "__complete"
+
+// historyFile returns the named file in the pwfz cache dir that remembers
+// queries (the history, the last query). PWFZ_HISTORY=0 disables both.
+func historyFile(name string) (string, bool) {
+	switch strings.ToLower(os.Getenv("PWFZ_HISTORY")) {
+	case "0", "false", "no", "off":
+		return "", false
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", false
+	}
+	return filepath.Join(dir, "pwfz", name), true
+}
+
+type historyEntry struct {
+	query, name string
+}
+
+// loadHistory reads the history file, oldest first. Each line is the query
+// and the chosen entry's name separated by a tab.
+func loadHistory() []historyEntry {
+	path, ok := historyFile("history")
+	if !ok {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var hist []historyEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		q, name, _ := strings.Cut(line, "\t")
+		if q != "" {
+			hist = append(hist, historyEntry{q, name})
+		}
+	}
+	return hist
+}
+
+// recordHistory moves query to the end of the history file, dropping any
+// earlier occurrence. Failures only show up with -v: history is a
+// convenience and must never fail a copy.
+func recordHistory(query, name string) {
+	clean := strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+	query = strings.TrimSpace(clean.Replace(query))
+	if query == "" {
+		return
+	}
+	path, ok := historyFile("history")
+	if !ok {
+		return
+	}
+	hist := slices.DeleteFunc(loadHistory(), func(h historyEntry) bool { return h.query == query })
+	hist = append(hist, historyEntry{query, clean.Replace(name)})
+	if len(hist) > maxHistory {
+		hist = hist[len(hist)-maxHistory:]
+	}
+	var b strings.Builder
+	for _, h := range hist {
+		fmt.Fprintf(&b, "%s\t%s\n", h.query, h.name)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		debugf("history not saved: %v", err)
+		return
+	}
+	if err := writeFileAtomic(path, []byte(b.String()), 0o600); err != nil {
+		debugf("history not saved: %v", err)
+	}
+}
+
+// loadLastQuery returns the query of the last search that found
+// something, or "".
+func loadLastQuery() string {
+	path, ok := historyFile("last-query")
+	if !ok {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// saveLastQuery remembers query for the next run without arguments. Like
+// recordHistory it only reports failures under -v.
+func saveLastQuery(query string) {
+	query = strings.TrimSpace(query)
+	path, ok := historyFile("last-query")
+	if !ok || query == "" || strings.ContainsAny(query, "\r\n") {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		debugf("last query not saved: %v", err)
+		return
+	}
+	if err := writeFileAtomic(path, []byte(query+"\n"), 0o600); err != nil {
+		debugf("last query not saved: %v", err)
+	}
+}
+
+func completeMain(args []string) {
+	hist := loadHistory()
+	for i := len(hist) - 1; i >= 0; i-- {
+		fmt.Println(hist[i].query)
+	}
+}
+
+const bashCompletion = `# pwfz bash completion: eval "$(pwfz completion bash)"
+_pwfz() {
+	local cur=${COMP_WORDS[COMP_CWORD]} IFS=$'\n'
+	[[ $cur == -* ]] && return
+	COMPREPLY=($(compgen -W "$(pwfz __complete 2>/dev/null)" -- "$cur"))
+}
+complete -o default -F _pwfz pwfz
+`
+
+const zshCompletion = `#compdef pwfz
+# pwfz zsh completion: eval "$(pwfz completion zsh)"
+_pwfz() {
+	local -a queries
+	queries=("${(@f)$(pwfz __complete 2>/dev/null)}")
+	compadd -Q -a queries
+}
+compdef _pwfz pwfz
+`
+
+const fishCompletion = `# pwfz fish completion: pwfz completion fish | source
+complete -c pwfz -f -a '(pwfz __complete 2>/dev/null)' -d 'recent query'
+`
 
-	return fmt.Sprintf("%s	%s", p.ID, display)
+func completionMain(args []string) error {
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pwfz completion bash|zsh|fish")
+	}
+	flagsDefined(fs)
+	fs.Parse(args)
+
+	scripts := map[string]string{"bash": bashCompletion, "zsh": zshCompletion, "fish": fishCompletion}
+	script, ok := scripts[fs.Arg(0)]
+	if fs.NArg() != 1 || !ok {
+		fs.Usage()
+		return configError(fmt.Errorf("unknown shell %q", fs.Arg(0)))
+	}
+	fmt.Print(script)
+	return nil
 }
 
 // -----------------------------------------------------------------------------
-// main
+// federation
 // -----------------------------------------------------------------------------
 
-func main() {
-	query := ""
-	if len(os.Args) > 1 {
-		query = strings.Join(os.Args[1:], " ")
+// instance is one Passwork server searched by the main command. There is
+// more than one when PASSWORK_BASE_URL lists several URLs.
+type instance struct {
+	tag    string // shown in fzf lines; empty with a single instance
+	cfg    Config
+	client *http.Client
+	token  string
+}
+
+func newInstances(cfgs []Config) []*instance {
+	out := make([]*instance, len(cfgs))
+	for i, cfg := range cfgs {
+		in := &instance{cfg: cfg, client: newHTTPClient(cfg)}
+		if len(cfgs) > 1 {
+			in.tag = cfg.BaseURL
+			if u, err := neturl.Parse(cfg.BaseURL); err == nil && u.Host != "" {
+				in.tag = u.Host
+			}
+		}
+		out[i] = in
 	}
+	return out
+}
+
+// observe records a phase timing in the metrics and, with -v, on stderr.
+func (in *instance) observe(phase string, d time.Duration) {
+	metrics.observe(phase, d)
+	debugf("%s%s took %s", in.logPrefix(), phase, d.Round(time.Millisecond))
+}
 
-	cfg := Config{
-		BaseURL: os.Getenv("PASSWORK_BASE_URL"),
-		APIKey:  os.Getenv("PASSWORK_API_KEY"),
+func (in *instance) logPrefix() string {
+	if in.tag == "" {
+		return ""
 	}
-	if cfg.BaseURL == "" {
-		fmt.Fprintln(os.Stderr, "PASSWORK_BASE_URL environment variable is not set")
-		os.Exit(1)
+	return in.tag + ": "
+}
+
+// collect logs into the instance, searches it and fetches the details of
+// every hit, tagging each entry with its origin.
+func (in *instance) collect(ctx context.Context, query string) ([]passwordDetail, error) {
+	hits, err := in.search(ctx, query)
+	if err != nil {
+		return nil, err
 	}
+	return in.fetch(ctx, hits), nil
+}
 
-	ctx := context.Background()
-	client := newHTTPClient()
+// fetch loads the details of hits from the instance, tagging each entry
+// with its origin.
+func (in *instance) fetch(ctx context.Context, hits []passwordSearchHit) []passwordDetail {
+	phase := time.Now()
+	details := fetchDetails(ctx, in.cfg, in.client, &in.token, hits)
+	in.observe("fetch", time.Since(phase))
+	for i := range details {
+		details[i].src = in
+	}
+	return details
+}
 
-	token, err := login(ctx, cfg, client)
+// search logs into the instance and returns its search hits.
+func (in *instance) search(ctx context.Context, query string) ([]passwordSearchHit, error) {
+	phase := time.Now()
+	token, err := login(ctx, in.cfg, in.client)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "login error: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("login error: %w", err)
 	}
+	in.token = token
+	in.observe("login", time.Since(phase))
 
-	hits, err := searchPasswords(ctx, cfg, client, token, query)
+	phase = time.Now()
+	hits, err := searchEntries(ctx, in.cfg, in.client, &in.token, query)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "search error: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("search error: %w", err)
 	}
-	if len(hits) == 0 {
-		fmt.Fprintf(os.Stderr, "no passwords found for query %q\n", query)
+	in.observe("search", time.Since(phase))
+	debugf("%ssearch %q: %d hits", in.logPrefix(), query, len(hits))
+	return hits, nil
+}
+
+// -----------------------------------------------------------------------------
+// doctor
+// -----------------------------------------------------------------------------
+
+// doctorReport prints one PASS, WARN or FAIL line per check and remembers
+// whether anything failed.
+type doctorReport struct {
+	failed bool
+}
+
+func (r *doctorReport) check(status, what, format string, args ...any) {
+	if status == "FAIL" {
+		r.failed = true
+	}
+	fmt.Fprintf(stdout, "%-4s  %-10s  %s\n", status, what, fmt.Sprintf(format, args...))
+}
+
+// doctorMain implements "pwfz doctor": it checks the configuration, each
+// instance's reachability and login, fzf and the clipboard. It never
+// searches and never prints the API key or a token.
+func doctorMain(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pwfz doctor [flags]")
+		fs.PrintDefaults()
+	}
+	addCommonFlags(fs)
+	flagsDefined(fs)
+	fs.Parse(args)
+
+	var r doctorReport
+	cfgs, err := configsFromEnv()
+	if err != nil {
+		r.check("FAIL", "config", "%v", err)
+	} else {
+		r.check("PASS", "config", "%d instance(s), profile %q", len(cfgs), cfgs[0].Profile)
+	}
+
+	ctx := context.Background()
+	for _, in := range newInstances(cfgs) {
+		doctorInstance(ctx, &r, in)
+	}
+
+	switch bin, err := resolveFzfBin(); {
+	case errors.Is(err, errNoFzf):
+		r.check("WARN", "fzf", "not found; the numbered prompt is used instead")
+	case err != nil:
+		r.check("FAIL", "fzf", "%v", err)
+	default:
+		out, err := exec.Command(bin, "--version").Output()
+		if err != nil {
+			r.check("FAIL", "fzf", "%s --version: %v", bin, err)
+		} else {
+			version, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+			if version != "" {
+				bin += " (" + version + ")"
+			}
+			r.check("PASS", "fzf", "%s", bin)
+		}
+	}
+	if _, err := splitWords(os.Getenv("PWFZ_FZF_OPTS")); err != nil {
+		r.check("FAIL", "fzf", "PWFZ_FZF_OPTS: %v", err)
+	}
+
+	if host, _ := sshClipboardCommand(); host != "" {
+		r.check("PASS", "clipboard", "over SSH to %s (PWFZ_CLIP_SSH)", host)
+	} else if cmdArgs := detectClipboardCommand(); cmdArgs == nil {
+		r.check("WARN", "clipboard", "no clipboard command found; OSC 52 through the terminal is used instead")
+	} else if path, err := exec.LookPath(cmdArgs[0]); err != nil {
+		r.check("FAIL", "clipboard", "%s: %v", cmdArgs[0], err)
+	} else {
+		r.check("PASS", "clipboard", "%s", path)
+	}
+
+	if r.failed {
+		return errors.New("pwfz doctor: some checks failed")
+	}
+	return nil
+}
+
+// doctorInstance checks that one instance answers at all, then that the API
+// key logs in. The fresh token is discarded, not cached.
+func doctorInstance(ctx context.Context, r *doctorReport, in *instance) {
+	what := "server"
+	if in.tag != "" {
+		what = in.tag
+	}
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, in.cfg.BaseURL, nil)
+	if err != nil {
+		r.check("FAIL", what, "%v", err)
+		return
+	}
+	setCommonHeaders(req, in.cfg, "")
+	resp, err := in.client.Do(req)
+	if err != nil {
+		r.check("FAIL", what, "%s is not reachable: %v", in.cfg.BaseURL, err)
 		return
 	}
+	resp.Body.Close()
+	r.check("PASS", what, "%s answers (HTTP %d)", in.cfg.BaseURL, resp.StatusCode)
 
-	// Fetch full details for each id
-	details := make([]passwordDetail, 0, len(hits))
-	for _, h := range hits {
-		d, err := getPassword(ctx, cfg, client, token, h.ID)
+	if _, _, err := requestToken(ctx, in.cfg, in.client); err != nil {
+		r.check("FAIL", "login", "%s%v", in.logPrefix(), err)
+		return
+	}
+	r.check("PASS", "login", "%sthe API key is accepted", in.logPrefix())
+}
+
+// -----------------------------------------------------------------------------
+// metrics
+// -----------------------------------------------------------------------------
+
+// runMetrics collects counters for -metrics-file. Only aggregate numbers are
+// recorded: no entry names, IDs or secrets ever become labels.
+type runMetrics struct {
+	mu          sync.Mutex
+	path        string
+	start       time.Time
+	phases      []string
+	durations   map[string]time.Duration
+	entries     int
+	fetchErrors int
+	written     bool
+}
+
+var metrics = &runMetrics{start: time.Now(), durations: map[string]time.Duration{}}
+
+func (m *runMetrics) observe(phase string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.durations[phase]; !ok {
+		m.phases = append(m.phases, phase)
+	}
+	m.durations[phase] += d
+}
+
+func (m *runMetrics) fetchError() {
+	m.mu.Lock()
+	m.fetchErrors++
+	m.mu.Unlock()
+}
+
+// write renders the metrics in Prometheus text format and atomically
+// replaces the target file (temp file + rename), as node_exporter's
+// textfile collector expects.
+func (m *runMetrics) write(success bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.path == "" || m.written {
+		return
+	}
+	m.written = true
+
+	ok := 0
+	if success {
+		ok = 1
+	}
+	var b strings.Builder
+	fmt.Fprintln(&b, "# HELP pwfz_last_run_timestamp_seconds Unix time the last pwfz run finished.")
+	fmt.Fprintln(&b, "# TYPE pwfz_last_run_timestamp_seconds gauge")
+	fmt.Fprintf(&b, "pwfz_last_run_timestamp_seconds %d\n", time.Now().Unix())
+	fmt.Fprintln(&b, "# HELP pwfz_last_run_success Whether the last pwfz run succeeded (1) or failed (0).")
+	fmt.Fprintln(&b, "# TYPE pwfz_last_run_success gauge")
+	fmt.Fprintf(&b, "pwfz_last_run_success %d\n", ok)
+	fmt.Fprintln(&b, "# HELP pwfz_entries_fetched Entries whose details were fetched in the last run.")
+	fmt.Fprintln(&b, "# TYPE pwfz_entries_fetched gauge")
+	fmt.Fprintf(&b, "pwfz_entries_fetched %d\n", m.entries)
+	fmt.Fprintln(&b, "# HELP pwfz_fetch_errors Detail fetches that failed in the last run.")
+	fmt.Fprintln(&b, "# TYPE pwfz_fetch_errors gauge")
+	fmt.Fprintf(&b, "pwfz_fetch_errors %d\n", m.fetchErrors)
+	fmt.Fprintln(&b, "# HELP pwfz_phase_duration_seconds Time spent in each phase of the last run.")
+	fmt.Fprintln(&b, "# TYPE pwfz_phase_duration_seconds gauge")
+	for _, p := range m.phases {
+		fmt.Fprintf(&b, "pwfz_phase_duration_seconds{phase=%q} %g\n", p, m.durations[p].Seconds())
+	}
+	fmt.Fprintf(&b, "pwfz_phase_duration_seconds{phase=\"total\"} %g\n", time.Since(m.start).Seconds())
+
+	if err := writeFileAtomic(m.path, []byte(b.String()), 0o644); err != nil {
+		warnf("write metrics file: %v", err)
+	}
+}
+
+// writeFileAtomic writes data next to path and renames it into place so
+// readers never see a partial file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// printSelected writes a "name<TAB>value" line to stdout for each entry
+// chosen with -multi. Every entry is loaded and checked first, so a failure
+// leaves stdout empty.
+func printSelected(ctx context.Context, chosen []*passwordDetail, o copyOptions) error {
+	var out bytes.Buffer
+	defer func() { clear(out.Bytes()) }()
+	for _, p := range chosen {
+		if err := loadEntry(ctx, p.src.cfg, p.src.client, p.src.token, p); err != nil {
+			return err
+		}
+		if err := confirmSensitiveCopy(*p); err != nil {
+			return err
+		}
+		warnIfExpiring(*p)
+		value, _, err := valueToCopy(*p, o)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "warning: skip %s: %v\n", h.ID, err)
+			return err
+		}
+		if bytes.ContainsAny(value, "\r\n") {
+			clear(value)
+			return fmt.Errorf("the value of %q spans several lines and cannot be printed with -multi", p.Name)
+		}
+		out.WriteString(strings.ReplaceAll(orEmpty(p.Name), "\t", " "))
+		out.WriteByte('\t')
+		out.Write(value)
+		out.WriteByte('\n')
+		clear(value)
+	}
+	_, err := os.Stdout.Write(out.Bytes())
+	return err
+}
+
+// countEntries prints the number of search hits across instances for
+// -count. The details are never fetched, so filters that need them do not
+// apply.
+func countEntries(ctx context.Context, instances []*instance, query string, limit time.Duration) error {
+	total := 0
+	var lastErr error
+	for _, in := range instances {
+		hits, err := in.search(ctx, query)
+		if err = timeoutError(err, limit); err != nil {
+			if len(instances) == 1 {
+				return err
+			}
+			warnf("%s: %v", in.tag, err)
+			lastErr = err
 			continue
 		}
-		details = append(details, d)
+		lastErr = nil
+		total += len(hits)
 	}
-	if len(details) == 0 {
-		fmt.Fprintf(os.Stderr, "no usable password entries\n")
-		return
+	if lastErr != nil && total == 0 {
+		return noInstanceError(lastErr)
 	}
+	fmt.Fprintln(stdout, total)
+	return nil
+}
 
-	lines := make([]string, 0, len(details))
-	for _, d := range details {
-		lines = append(lines, buildFzfLine(d))
+// pipelineContext applies PWFZ_TIMEOUT, which bounds login+search+fetch as
+// a whole; time spent in fzf and acting on the selected entry is not
+// counted. limit is 0 when no timeout is set.
+func pipelineContext(ctx context.Context) (pipeline context.Context, cancel context.CancelFunc, limit time.Duration) {
+	limit = envDuration("PWFZ_TIMEOUT", 0)
+	if limit <= 0 {
+		return ctx, func() {}, 0
 	}
+	pipeline, cancel = context.WithTimeout(ctx, limit)
+	return pipeline, cancel, limit
+}
+
+// timeoutError turns the expiry of PWFZ_TIMEOUT into a readable error.
+func timeoutError(err error, limit time.Duration) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &exitError{code: exitNetwork, err: fmt.Errorf("operation timed out after %s (PWFZ_TIMEOUT)", limit)}
+	}
+	return err
+}
+
+// noInstanceError reports that every instance failed, with the exit status
+// of the last failure.
+func noInstanceError(last error) error {
+	return &exitError{code: exitCodeFor(last), err: errors.New("no Passwork instance could be searched")}
+}
+
+// -----------------------------------------------------------------------------
+// exit statuses
+// -----------------------------------------------------------------------------
+
+// Exit statuses, so scripts can tell the failure classes apart. flag's
+// ExitOnError already exits with 2 for a bad command line, which fits
+// exitConfig.
+const (
+	exitConfig    = 2   // invalid flags, environment or config file
+	exitAuth      = 3   // login refused, or the session rejected (401/403)
+	exitNetwork   = 4   // unreachable server, 502-504, or a timeout
+	exitNoResults = 5   // nothing matched, or the entry is gone (404)
+	exitCancelled = 130 // fzf or the prompt was left without a choice
+)
+
+// exitError attaches an exit status to err.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// configError marks err as a configuration or usage problem.
+func configError(err error) error {
+	return &exitError{code: exitConfig, err: err}
+}
+
+// noResults reports that the search left nothing to choose from.
+func noResults(format string, args ...any) error {
+	return &exitError{code: exitNoResults, err: fmt.Errorf(format, args...)}
+}
+
+// errCancelled ends a run in which nothing was chosen; run prints nothing
+// for it.
+var errCancelled = &exitError{code: exitCancelled, err: errors.New("nothing selected")}
+
+// exitCodeFor maps err to the process exit status; errors without a class
+// exit with 1.
+func exitCodeFor(err error) int {
+	var ee *exitError
+	var ae *APIError
+	var ne net.Error
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &ee):
+		return ee.code
+	case errors.As(err, &ae):
+		switch {
+		case ae.Op == "login" && ae.Status >= 400 && ae.Status < 500:
+			return exitAuth
+		}
+		switch ae.Status {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return exitAuth
+		case http.StatusNotFound:
+			return exitNoResults
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return exitNetwork
+		}
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne):
+		return exitNetwork
+	}
+	return 1
+}
+
+// -----------------------------------------------------------------------------
+// main
+// -----------------------------------------------------------------------------
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run executes pwfz and returns its exit status. Errors are printed here,
+// once; a cancelled selection exits quietly.
+func run(argv []string) int {
+	err := runArgs(argv)
+	code := exitCodeFor(err)
+	if err != nil && !errors.Is(err, errCancelled) {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	// A search that found or chose nothing still ran fine.
+	metrics.write(code == 0 || code == exitNoResults || code == exitCancelled)
+	return code
+}
 
-	selected, err := runFzf(lines)
+func runArgs(argv []string) error {
+	if err := checkArgvSecrets(argv, "on the command line, where other users can see it"); err != nil {
+		return configError(err)
+	}
+	args, err := expandArgFiles(argv)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "fzf error: %v\n", err)
-		os.Exit(1)
+		return configError(err)
 	}
-	if selected == "" {
-		return
+	if err := checkArgvSecrets(args, "in an argument file"); err != nil {
+		return configError(err)
+	}
+	if err := setupOutputCharset(); err != nil {
+		return configError(err)
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "delete":
+			return deleteMain(args[1:])
+		case "add":
+			return addMain(args[1:])
+		case "import":
+			return importMain(args[1:])
+		case "edit":
+			return editMain(args[1:])
+		case "history":
+			return historyMain(args[1:])
+		case "sync":
+			return syncMain(args[1:])
+		case "doctor":
+			return doctorMain(args[1:])
+		case "benchmark":
+			return benchmarkMain(args[1:])
+		case "schema":
+			return schemaMain(args[1:])
+		case "completion":
+			return completionMain(args[1:])
+		case completeCommand:
+			completeMain(args[1:])
+			return nil
+		case clearClipboardCommand:
+			clearClipboardMain(args[1:])
+			return nil
+		case restoreClipboardCommand:
+			restoreClipboardMain(args[1:])
+			return nil
+		case previewCommand:
+			previewMain(args[1:])
+			return nil
+		}
+	}
+	return searchMain(args)
+}
+
+// searchMain is the default command: search, pick an entry and copy (or
+// print) its value.
+func searchMain(args []string) error {
+	fs := flag.NewFlagSet("pwfz", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pwfz [flags] [search query...]")
+		fs.PrintDefaults()
+	}
+	addCommonFlags(fs)
+	filters := addFilterFlags(fs)
+	fs.BoolVar(&strict, "strict", false, "fail instead of warning when the value exceeds PWFZ_MAX_CLIP_BYTES")
+	checkStrength := fs.Bool("check-strength", false, "warn when the copied password looks weak (advisory only)")
+	outputFD := fs.Int("output-fd", 0, "write the value to open file descriptor `N` (>= 3) instead of the clipboard")
+	toStdout := fs.Bool("stdout", false, "print the value to stdout, without a newline, instead of copying it")
+	newline := fs.Bool("newline", false, "with -stdout, end the value with a newline")
+	multi := fs.Bool("multi", false, "select several entries (Tab in fzf) and print \"name<TAB>value\" lines to stdout")
+	fromClipboard := fs.Bool("query-from-clipboard", false, "use the current clipboard contents as the search query")
+	withTOTP := fs.Bool("copy-password-and-totp", false, "copy the password, then the entry's TOTP code after Enter (TTY only)")
+	copyOpts := addCopyFlags(fs)
+	first := fs.Bool("first", false, "skip fzf and take the first result (warns when several match)")
+	maxMatches := fs.Int("max-matches", 0, "with -first, fail instead of copying when the search finds more than `N` entries")
+	noLast := fs.Bool("no-last", false, "without a query, do not pre-fill fzf with the last query")
+	list := fs.Bool("list", false, "print the matching entries' lines to stdout and exit, without fzf or the clipboard")
+	count := fs.Bool("count", false, "print the number of search hits and exit, without fetching any entry")
+	asJSON := fs.Bool("json", false, "print the selected entry as JSON (with the decoded password) instead of copying")
+	jsonExclude := fs.String("json-exclude", "", "with -json, leave out these comma-separated `fields`, e.g. password,custom")
+	metricsFile := fs.String("metrics-file", "", "write Prometheus textfile metrics for this run to `path`")
+	flagsDefined(fs)
+	fs.Parse(args)
+	query := strings.Join(fs.Args(), " ")
+
+	metrics.path = *metricsFile
+
+	if err := copyOpts.check(); err != nil {
+		return configError(err)
+	}
+	if *fromClipboard {
+		if query != "" {
+			return configError(errors.New("-query-from-clipboard cannot be combined with a query argument"))
+		}
+		q, err := readClipboard()
+		if err != nil {
+			return fmt.Errorf("clipboard error: %w", err)
+		}
+		query = q
+		debugf("query from clipboard: %q", query)
+	}
+	// The search itself stays unfiltered, so clearing the pre-filled
+	// query in fzf shows everything.
+	if query == "" && !*noLast && !*first && !*list && !*count {
+		filters.fzfQuery = loadLastQuery()
+	}
+	if *outputFD != 0 && *outputFD < 3 {
+		return configError(errors.New("-output-fd must be 3 or higher (0-2 are stdin/stdout/stderr)"))
+	}
+	if *asJSON && (*outputFD != 0 || *withTOTP) {
+		return configError(errors.New("-json cannot be combined with -output-fd or -copy-password-and-totp"))
+	}
+	if *multi && (*first || *outputFD != 0 || *withTOTP || *asJSON) {
+		return configError(errors.New("-multi cannot be combined with -first, -output-fd, -json or -copy-password-and-totp"))
+	}
+	if *toStdout && (*outputFD != 0 || *withTOTP || *asJSON) {
+		return configError(errors.New("-stdout cannot be combined with -output-fd, -json or -copy-password-and-totp"))
+	}
+	if *jsonExclude != "" && !*asJSON {
+		return configError(errors.New("-json-exclude only applies with -json"))
+	}
+	excluded, err := parseJSONExclude(*jsonExclude)
+	if err != nil {
+		return configError(err)
+	}
+	if *maxMatches < 0 || (*maxMatches > 0 && !*first) {
+		return configError(errors.New("-max-matches takes a positive count and only applies with -first"))
+	}
+	if *newline && *multi {
+		return configError(errors.New("-newline cannot be combined with -multi, whose lines always end in a newline"))
+	}
+	if *newline && !*toStdout {
+		return configError(errors.New("-newline only applies with -stdout"))
+	}
+	if *withTOTP && !isTerminal(os.Stdin) {
+		return configError(errors.New("-copy-password-and-totp needs an interactive terminal"))
+	}
+
+	cfgs, err := configsFromEnv()
+	if err != nil {
+		return configError(err)
+	}
+	if !*first && !*list && !*count {
+		if _, err := chooseSelector(); err != nil {
+			return configError(err)
+		}
+	}
+
+	ctx := context.Background()
+	instances := newInstances(cfgs)
+
+	pipeline, cancel, limit := pipelineContext(ctx)
+	defer cancel()
+
+	if *count {
+		return countEntries(pipeline, instances, query, limit)
+	}
+
+	// With several instances one being down is not fatal; the others are
+	// still searched. Every instance is searched before anything is
+	// fetched, so -max-matches can refuse an over-broad query early.
+	type searched struct {
+		in   *instance
+		hits []passwordSearchHit
+	}
+	var reached []searched
+	var lastErr error
+	total := 0
+	for _, in := range instances {
+		hits, err := in.search(pipeline, query)
+		if err = timeoutError(err, limit); err != nil {
+			if len(instances) == 1 {
+				return err
+			}
+			warnf("%s: %v", in.tag, err)
+			lastErr = err
+			continue
+		}
+		reached = append(reached, searched{in, hits})
+		total += len(hits)
+	}
+	if len(reached) == 0 {
+		return noInstanceError(lastErr)
+	}
+	if *maxMatches > 0 && total > *maxMatches {
+		return fmt.Errorf("-first: %d entries match %q, more than -max-matches %d; nothing was copied", total, query, *maxMatches)
+	}
+	var fetched []passwordDetail
+	for _, r := range reached {
+		d := r.in.fetch(pipeline, r.hits)
+		filters.resolveVault(ctx, r.in.cfg, r.in.client, r.in.token)
+		if filters.needVaultNames() {
+			nameVaults(ctx, r.in.cfg, r.in.client, r.in.token, d)
+		}
+		fetched = append(fetched, d...)
+	}
+	if len(fetched) == 0 {
+		return noResults("no passwords found for query %q", query)
+	}
+	saveLastQuery(query)
+	metrics.entries = loadedCount(fetched)
+	details := filterDetails(fetched, filters)
+	if len(details) == 0 {
+		return noResults("no usable password entries")
+	}
+
+	if *list {
+		listEntries(details)
+		return nil
 	}
 
-	// first field (before \t) is id
-	id := strings.SplitN(selected, "\t", 2)[0]
+	if *multi {
+		picked, _, err := selectEntries(details, buildHeader(query, cfgs[0].Profile, filters.vault, len(details))+" · tab: select several", filters, true)
+		if err != nil {
+			return err
+		}
+		if len(picked) == 0 {
+			return errCancelled
+		}
+		if err := printSelected(ctx, picked, *copyOpts); err != nil {
+			return err
+		}
+		for _, p := range picked {
+			recordHistory(query, p.Name)
+		}
+		return nil
+	}
 
 	var chosen *passwordDetail
-	for i := range details {
-		if details[i].ID == id {
-			chosen = &details[i]
-			break
+	var key string
+	if *first {
+		chosen = firstEntry(details)
+	} else {
+		help, keys := actionHeader()
+		chosen, key, err = selectEntry(details, buildHeader(query, cfgs[0].Profile, filters.vault, len(details))+" · "+help, filters, keys...)
+		if err != nil {
+			return err
 		}
 	}
 	if chosen == nil {
-		fmt.Fprintf(os.Stderr, "could not find password for selected id %s\n", id)
-		os.Exit(1)
+		return errCancelled
+	}
+	if err := loadEntry(ctx, chosen.src.cfg, chosen.src.client, chosen.src.token, chosen); err != nil {
+		return err
 	}
 
-	if chosen.CryptedPassword == "" {
-		fmt.Fprintf(os.Stderr, "selected entry has empty cryptedPassword\n")
-		os.Exit(1)
+	// The details carry no secrets, so they skip the sensitive-tag check.
+	if key == detailsKey {
+		fmt.Fprint(stdout, renderPreview(*chosen))
+		recordHistory(query, chosen.Name)
+		return nil
 	}
 
-	// cryptedPassword is base64-encoded – decode before copying
-	raw := chosen.CryptedPassword
-	decoded, err := base64.StdEncoding.DecodeString(raw)
+	if err := confirmSensitiveCopy(*chosen); err != nil {
+		return err
+	}
+	warnIfExpiring(*chosen)
+
+	if key == attachKey {
+		return saveAttachment(ctx, chosen.src, *chosen)
+	}
+	if key == openKey {
+		if strings.TrimSpace(chosen.URL) != "" {
+			if err := openURL(chosen.URL); err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, "Opened the URL of %q.\n", chosen.Name)
+			return nil
+		}
+		warnf("entry %q has no URL, copying the password instead", chosen.Name)
+		key = ""
+		*copyOpts = copyOptions{mode: "password"}
+	}
+
+	if *asJSON {
+		out, err := entryJSON(*chosen, excluded)
+		if err != nil {
+			return err
+		}
+		defer clear(out)
+		return writeJSON(out)
+	}
+
+	if *withTOTP {
+		if *checkStrength {
+			if pw, err := decodePassword(*chosen); err == nil {
+				warnIfWeak(*chosen, pw)
+			}
+		}
+		if err := copyPasswordThenTOTP(*chosen); err != nil {
+			return err
+		}
+		recordHistory(query, chosen.Name)
+		ringBell()
+		return nil
+	}
+
+	var value []byte
+	var what string
+	switch key {
+	case passwordKey:
+		value, what, err = valueToCopy(*chosen, copyOptions{mode: "password", caseMode: copyOpts.caseMode})
+	case totpKey:
+		var code string
+		code, err = entryTOTP(*chosen)
+		value, what = []byte(code), "TOTP code"
+	case loginKey:
+		value, what, err = valueToCopy(*chosen, copyOptions{mode: "login", caseMode: copyOpts.caseMode})
+	default:
+		value, what, err = valueToCopy(*chosen, *copyOpts)
+	}
 	if err != nil {
-		// If decoding fails for some reason, fall back to raw value
-		fmt.Fprintf(os.Stderr, "warning: cannot base64-decode cryptedPassword, copying raw value: %v\n", err)
-	} else {
-		raw = string(decoded)
+		return err
+	}
+	// Every path below is done with the value once it returns, including
+	// the restore wait; the detached clearer gets its own copy.
+	defer clear(value)
+	if *checkStrength && what == "password" {
+		warnIfWeak(*chosen, string(value))
 	}
 
-	if err := copyToClipboard(raw); err != nil {
-		fmt.Fprintf(os.Stderr, "clipboard error: %v\n", err)
-		os.Exit(1)
+	if *outputFD != 0 {
+		return writeToFD(*outputFD, value)
+	}
+	// The value is written untranscoded, like -output-fd, and nothing else
+	// goes to stdout, so $(pwfz -stdout ...) captures exactly the secret.
+	if *toStdout {
+		if _, err := os.Stdout.Write(value); err != nil || !*newline {
+			return err
+		}
+		_, err := io.WriteString(os.Stdout, "\n")
+		return err
+	}
+
+	saved, restore := snapshotClipboard()
+	if err := copyToClipboard(value); err != nil {
+		return fmt.Errorf("clipboard error: %w", err)
 	}
 
-	fmt.Printf("Copied password for %q to clipboard.\n", chosen.Name)
+	fmt.Fprintf(stdout, "Copied %s for %q to clipboard.\n", what, chosen.Name)
+	recordHistory(query, chosen.Name)
+	ringBell()
+
+	if err := runPasteAppCommand(); err != nil {
+		warnf("paste app command failed: %v", err)
+	}
+
+	scheduleCleanup(value, saved, restore)
+	return nil
 }
@@ -0,0 +1,801 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func hitIDs(hits []passwordSearchHit) []string {
+	ids := make([]string, len(hits))
+	for i, h := range hits {
+		ids[i] = h.ID
+	}
+	return ids
+}
+
+func TestDedupeHits(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{"empty", nil, []string{}},
+		{"no duplicates", []string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{"keeps first occurrence", []string{"b", "a", "b", "c", "a"}, []string{"b", "a", "c"}},
+		{"all the same", []string{"a", "a", "a"}, []string{"a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var in []passwordSearchHit
+			for _, id := range tt.in {
+				in = append(in, passwordSearchHit{ID: id, Name: "n-" + id})
+			}
+			got := dedupeHits(in)
+			if ids := hitIDs(got); !slices.Equal(ids, tt.want) {
+				t.Errorf("dedupeHits(%v) = %v, want %v", tt.in, ids, tt.want)
+			}
+			for _, h := range got {
+				if h.Name != "n-"+h.ID {
+					t.Errorf("hit %s has name %q, want the first occurrence's", h.ID, h.Name)
+				}
+			}
+		})
+	}
+}
+
+// A server that ignores offset/limit sends the same page every time; the
+// pager must stop after the first repeat and list each entry once.
+func TestSearchPasswordsIgnoredOffset(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		page := make([]passwordSearchHit, searchPageSize)
+		for i := range page {
+			page[i] = passwordSearchHit{ID: string(rune('a'+i%26)) + string(rune('a'+i/26)), Name: "x"}
+		}
+		page[1] = page[0] // the server repeats a hit within the page as well
+		json.NewEncoder(w).Encode(map[string]any{"status": "success", "data": page})
+	}))
+	defer srv.Close()
+
+	hits, err := searchPasswords(context.Background(), Config{BaseURL: srv.URL}, srv.Client(), "tok", "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("made %d search requests, want 2", calls)
+	}
+	if len(hits) != searchPageSize-1 {
+		t.Errorf("got %d hits, want %d", len(hits), searchPageSize-1)
+	}
+	if ids := hitIDs(hits); len(dedupeHits(hits)) != len(ids) {
+		t.Errorf("hits contain duplicates: %v", ids)
+	}
+}
+
+func TestConfigTrimsKeyAndURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		url     string
+		wantKey string
+		wantErr error
+	}{
+		{"trailing newline", "abc123\n", "https://pw.example.com/api/v4", "abc123", nil},
+		{"trailing CRLF", "abc123\r\n", "https://pw.example.com/api/v4", "abc123", nil},
+		{"surrounding spaces", "  abc123\t", "https://pw.example.com/api/v4", "abc123", nil},
+		{"newline in URL too", "abc123\n", "https://pw.example.com/api/v4\n", "abc123", nil},
+		{"inner whitespace", "abc 123\n", "https://pw.example.com/api/v4", "", errAPIKeyWhitespace},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PWFZ_PROFILE", "")
+			t.Setenv("PWFZ_API_KEY_CMD", "")
+			t.Setenv("PASSWORK_API_KEY", tt.key)
+			t.Setenv("PASSWORK_BASE_URL", tt.url)
+			cfg, err := configFromEnv()
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("configFromEnv() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.APIKey != tt.wantKey {
+				t.Errorf("APIKey = %q, want %q", cfg.APIKey, tt.wantKey)
+			}
+			if cfg.BaseURL != "https://pw.example.com/api/v4" {
+				t.Errorf("BaseURL = %q", cfg.BaseURL)
+			}
+		})
+	}
+}
+
+func TestExtractJSONKey(t *testing.T) {
+	const doc = `{"db":{"password":"s3cret","port":5432,"opts":{"ssl":true}},` +
+		`"replicas":[{"host":"r1"},{"host":"r2"}],"a.b":"dotted","top":"v"}`
+	tests := []struct {
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{key: "top", want: "v"},
+		{key: "db.password", want: "s3cret"},
+		{key: "db.port", want: "5432"},
+		{key: "db.opts", want: `{"ssl":true}`},
+		{key: "db.opts.ssl", want: "true"},
+		{key: "replicas.1.host", want: "r2"},
+		{key: "replicas", want: `[{"host":"r1"},{"host":"r2"}]`},
+		{key: "db.missing", wantErr: true},
+		{key: "replicas.2.host", wantErr: true},
+		{key: "replicas.x", wantErr: true},
+		{key: "top.deeper", wantErr: true},
+		{key: "a.b", wantErr: true}, // dots always separate path segments
+	}
+	for _, tt := range tests {
+		got, err := extractJSONKey(doc, tt.key)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("extractJSONKey(%q) = %q, want an error", tt.key, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("extractJSONKey(%q) = %q, %v; want %q", tt.key, got, err, tt.want)
+		}
+	}
+	if _, err := extractJSONKey("not json", "a"); err == nil {
+		t.Error("extractJSONKey on non-JSON input: want an error")
+	}
+}
+
+func TestResolveFzfBinBogusPath(t *testing.T) {
+	dir := t.TempDir()
+	notExec := filepath.Join(dir, "fzf-noexec")
+	if err := os.WriteFile(notExec, []byte("#!/bin/sh\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	okBin := filepath.Join(dir, "fzf-ok")
+	if err := os.WriteFile(okBin, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "no-such-fzf")
+
+	tests := []struct {
+		name    string
+		bin     string
+		wantErr string
+	}{
+		{"missing", missing, "FZF_BIN=" + missing + " not found"},
+		{"not executable", notExec, "exists but is not executable (try chmod +x " + notExec + ")"},
+		{"executable", okBin, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("FZF_BIN", tt.bin)
+			got, err := resolveFzfBin()
+			if tt.wantErr == "" {
+				if err != nil || got != tt.bin {
+					t.Fatalf("resolveFzfBin() = %q, %v; want %q", got, err, tt.bin)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("resolveFzfBin() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+			if errors.Is(err, errNoFzf) {
+				t.Error("a bad FZF_BIN must not be reported as fzf missing, or the plain prompt would hide it")
+			}
+		})
+	}
+}
+
+func TestFilterDetailsStableOrder(t *testing.T) {
+	ids := []string{"c3", "a1", "e5", "b2", "d4"}
+	want := []string{"a1", "b2", "c3", "d4", "e5"}
+	// Every rotation stands in for a different completion order of the
+	// concurrent fetches; -stable must hide it.
+	for r := range ids {
+		in := make([]passwordDetail, 0, len(ids))
+		for _, id := range slices.Concat(ids[r:], ids[:r]) {
+			in = append(in, passwordDetail{ID: id, Name: "entry"})
+		}
+		got := make([]string, 0, len(in))
+		for _, d := range filterDetails(in, &filterOptions{stable: true}) {
+			got = append(got, d.ID)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("rotation %d: order %v, want %v", r, got, want)
+		}
+	}
+
+	// Without -stable the fetch order is kept.
+	in := []passwordDetail{{ID: "b"}, {ID: "a"}}
+	if got := filterDetails(in, &filterOptions{}); got[0].ID != "b" {
+		t.Errorf("without -stable the order changed: %v", got)
+	}
+}
+
+func TestDecodeSearchHits(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []passwordSearchHit
+		wantErr bool
+	}{
+		{
+			name: "array",
+			data: `[{"id":"a1","name":"one"},{"id":"b2","name":"two"}]`,
+			want: []passwordSearchHit{{ID: "a1", Name: "one"}, {ID: "b2", Name: "two"}},
+		},
+		{
+			name: "object keyed by ID keeps server order",
+			data: `{"b2":{"id":"b2","name":"two"},"a1":{"id":"a1","name":"one"}}`,
+			want: []passwordSearchHit{{ID: "b2", Name: "two"}, {ID: "a1", Name: "one"}},
+		},
+		{
+			name: "object values without id take the key",
+			data: `{"c3":{"name":"three"}}`,
+			want: []passwordSearchHit{{ID: "c3", Name: "three"}},
+		},
+		{name: "empty array", data: `[]`, want: []passwordSearchHit{}},
+		{name: "empty object", data: `{}`, want: nil},
+		{name: "null", data: `null`, want: nil},
+		{name: "string", data: `"oops"`, wantErr: true},
+		{name: "bad array item", data: `[{"id":1}]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeSearchHits(json.RawMessage(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decodeSearchHits(%s) = %v, want an error", tt.data, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("decodeSearchHits(%s) = %v, want %v", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyNthCustomField(t *testing.T) {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	p := passwordDetail{Name: "codes entry", Custom: []customField{
+		{Name: b64("Recovery Codes"), Value: b64("c1\n c2 \n\nc3\n"), Type: "text"},
+		{Name: b64("csv"), Value: b64("x, y,z"), Type: "text"},
+	}}
+
+	tests := []struct {
+		name    string
+		sep     string
+		mode    string
+		nth     int
+		want    string
+		wantErr string
+	}{
+		{name: "first of newline list", mode: "custom:recovery codes", nth: 1, want: "c1"},
+		{name: "trims items", mode: "custom:Recovery Codes", nth: 2, want: "c2"},
+		{name: "skips empty lines", mode: "custom:Recovery Codes", nth: 3, want: "c3"},
+		{name: "out of range", mode: "custom:Recovery Codes", nth: 4, wantErr: "out of range: field has 3 item(s)"},
+		{name: "zero", mode: "custom:Recovery Codes", nth: 0, want: "c1\n c2 \n\nc3\n"},
+		{name: "custom separator", sep: ",", mode: "custom:csv", nth: 2, want: "y"},
+		{name: "escaped separator", sep: `\n`, mode: "custom:Recovery Codes", nth: 1, want: "c1"},
+		{name: "unknown field", mode: "custom:nope", nth: 1, wantErr: `no custom field "nope"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PWFZ_FIELD_SEP", tt.sep)
+			got, _, err := valueToCopy(p, copyOptions{mode: tt.mode, nth: tt.nth})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || string(got) != tt.want {
+				t.Fatalf("valueToCopy = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNthItem(t *testing.T) {
+	if _, err := nthItem("", "\n", 1); err == nil {
+		t.Error("nthItem on an empty field: want an error")
+	}
+	if _, err := nthItem("a\nb", "\n", -1); err == nil {
+		t.Error("nthItem with a negative index: want an error")
+	}
+	if got, err := nthItem("a;;b", ";;", 2); err != nil || got != "b" {
+		t.Errorf(`nthItem("a;;b", ";;", 2) = %q, %v; want "b"`, got, err)
+	}
+}
+
+// errFlagsDefined stops a subcommand right after it defined its flags.
+var errFlagsDefined = errors.New("flags defined")
+
+// TestNoSecretFlags walks the flag set of every subcommand: secrets must
+// reach pwfz through the environment, stdin, a file or a descriptor, never
+// a flag, so no value-taking flag may be named like one.
+func TestNoSecretFlags(t *testing.T) {
+	t.Setenv("PWFZ_READONLY", "")
+	subcommands := map[string]func([]string) error{
+		"pwfz":       searchMain,
+		"delete":     deleteMain,
+		"add":        addMain,
+		"edit":       editMain,
+		"history":    historyMain,
+		"benchmark":  benchmarkMain,
+		"schema":     schemaMain,
+		"sync":       syncMain,
+		"completion": completionMain,
+		"doctor":     doctorMain,
+	}
+	defer func(orig func(*flag.FlagSet)) { flagsDefined = orig }(flagsDefined)
+	for name, run := range subcommands {
+		var fs *flag.FlagSet
+		flagsDefined = func(f *flag.FlagSet) {
+			fs = f
+			panic(errFlagsDefined)
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != errFlagsDefined {
+					panic(r)
+				}
+			}()
+			run(nil)
+		}()
+		if fs == nil {
+			t.Errorf("%s: flagsDefined was not called", name)
+			continue
+		}
+		if bad := secretFlags(fs); len(bad) > 0 {
+			t.Errorf("%s: flags %v look secret-bearing; pass secrets through the environment or stdin instead", name, bad)
+		}
+	}
+}
+
+func TestSecretFlagsDetects(t *testing.T) {
+	fs := flag.NewFlagSet("x", flag.ContinueOnError)
+	fs.String("api-key", "", "")
+	fs.String("master-password", "", "")
+	fs.Bool("copy-password-and-totp", false, "")
+	fs.String("vault", "", "")
+	got := secretFlags(fs)
+	if want := []string{"api-key", "master-password"}; !slices.Equal(got, want) {
+		t.Errorf("secretFlags = %v, want %v", got, want)
+	}
+}
+
+func TestExpandArgFilesEscapes(t *testing.T) {
+	dir := t.TempDir()
+	inner := filepath.Join(dir, "inner.args")
+	outer := filepath.Join(dir, "outer.args")
+	if err := os.WriteFile(inner, []byte("# comment\n-folder\ninfra\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(outer, []byte("@"+inner+"\n@@team\n--\n@"+inner+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"pwfz", "@" + inner, "db"}, []string{"pwfz", "-folder", "infra", "db"}},
+		{[]string{"pwfz", "@@work"}, []string{"pwfz", "@work"}},
+		{[]string{"pwfz", "@@@work"}, []string{"pwfz", "@@work"}},
+		{[]string{"pwfz", "@"}, []string{"pwfz", "@"}},
+		{[]string{"pwfz", "--", "@work", "@@work"}, []string{"pwfz", "--", "@work", "@@work"}},
+		{[]string{"pwfz", "@" + outer, "@" + inner}, []string{"pwfz", "-folder", "infra", "@team", "--", "@" + inner, "@" + inner}},
+	}
+	for _, tt := range tests {
+		got, err := expandArgFiles(tt.args)
+		if err != nil {
+			t.Errorf("expandArgFiles(%q): %v", tt.args, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("expandArgFiles(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	if _, err := expandArgFiles([]string{"pwfz", "@" + filepath.Join(dir, "missing")}); err == nil {
+		t.Error("expandArgFiles with a missing file: no error")
+	}
+}
+
+func TestBuildHeader(t *testing.T) {
+	tests := []struct {
+		query, profile, vault string
+		n                     int
+		want                  string
+	}{
+		{"db", "", "", 3, "query: db · 3 results"},
+		{"", defaultProfile, "", 1, "query: (all) · 1 result"},
+		{"db", "work", "", 2, "profile: work · query: db · 2 results"},
+		{"db", "", "Infra", 2, "vault: Infra · query: db · 2 results"},
+		{"db", "work", "Infra", 12, "profile: work · vault: Infra · query: db · 12 results"},
+	}
+	for _, tt := range tests {
+		if got := buildHeader(tt.query, tt.profile, tt.vault, tt.n); got != tt.want {
+			t.Errorf("buildHeader(%q, %q, %q, %d) = %q, want %q", tt.query, tt.profile, tt.vault, tt.n, got, tt.want)
+		}
+	}
+}
+
+// JSON must reach stdout as UTF-8 whatever PWFZ_OUTPUT_CHARSET says; the
+// password in -json output would be mangled otherwise.
+func TestWriteJSONSkipsOutputCharset(t *testing.T) {
+	t.Setenv("PWFZ_OUTPUT_CHARSET", "iso-8859-1")
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	origStdout, origWriter, origEnc := os.Stdout, stdout, outputEnc
+	defer func() { os.Stdout, stdout, outputEnc = origStdout, origWriter, origEnc }()
+	os.Stdout = w
+	if err := setupOutputCharset(); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := []byte(`{"password":"pä€ss"}`)
+	if err := writeJSON(doc); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := string(doc) + "\n"; string(got) != want {
+		t.Errorf("writeJSON wrote %q, want %q", got, want)
+	}
+}
+
+func TestApplyProfileSettings(t *testing.T) {
+	zero := 0
+	fc := fileConfig{Profiles: map[string]fileProfile{
+		"client": {ClipBin: "osc-copy", FzfBin: "/opt/fzf", FzfOpts: "--border", ClearSeconds: &zero},
+	}}
+	defer func(orig func() (fileConfig, error)) { loadConfigFile = orig }(loadConfigFile)
+	loadConfigFile = func() (fileConfig, error) { return fc, nil }
+	defer func(orig string) { profile = orig }(profile)
+	profile = "client"
+
+	t.Setenv("CLIP_BIN", "wl-copy") // the environment wins
+	t.Setenv("FZF_BIN", "")
+	t.Setenv("PWFZ_FZF_OPTS", "")
+	t.Setenv("PWFZ_CLEAR_SECONDS", "")
+	applyProfileSettings()
+	for env, want := range map[string]string{
+		"CLIP_BIN":           "wl-copy",
+		"FZF_BIN":            "/opt/fzf",
+		"PWFZ_FZF_OPTS":      "--border",
+		"PWFZ_CLEAR_SECONDS": "0",
+	} {
+		if got := os.Getenv(env); got != want {
+			t.Errorf("%s = %q, want %q", env, got, want)
+		}
+	}
+
+	profile = "other"
+	t.Setenv("FZF_BIN", "")
+	applyProfileSettings()
+	if got := os.Getenv("FZF_BIN"); got != "" {
+		t.Errorf("FZF_BIN = %q from an unselected profile", got)
+	}
+}
+
+// An ID prefix must be matched locally: against the search's own hits and
+// the detail cache, never by listing every vault.
+func TestIDPrefixHitsNoEnumeration(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("PWFZ_CACHE_TTL", "1h")
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		http.Error(w, "unexpected request", http.StatusTeapot)
+	}))
+	defer srv.Close()
+	cfg := Config{BaseURL: srv.URL, APIKey: "k"}
+
+	cache := openDetailCache(cfg)
+	cache.put(passwordDetail{ID: "5f3a9c01ffffffffffffffff", Name: "cached"})
+	cache.put(passwordDetail{ID: "77aa9c01ffffffffffffffff", Name: "other"})
+	cache.save()
+
+	hits := []passwordSearchHit{
+		{ID: "5f3a9c01aa00bb11cc22dd33", Name: "searched"},
+		{ID: "0000000000000000000000aa", Name: "name match"},
+	}
+	token := "tok"
+	got := idPrefixHits(context.Background(), cfg, srv.Client(), &token, "5F3A9C01", hits)
+	if want := []string{"5f3a9c01aa00bb11cc22dd33", "5f3a9c01ffffffffffffffff"}; !slices.Equal(hitIDs(got), want) {
+		t.Errorf("idPrefixHits = %v, want %v", hitIDs(got), want)
+	}
+	if len(paths) > 0 {
+		t.Errorf("prefix lookup sent requests: %v", paths)
+	}
+}
+
+// Entries kept in folders, or with no path at all, must still be grouped
+// under their vault's name, which only the vault list knows.
+func TestNameVaultsFolderEntries(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/vaults" {
+			http.Error(w, "unexpected", http.StatusTeapot)
+			return
+		}
+		calls++
+		json.NewEncoder(w).Encode(map[string]any{"status": "success", "data": []vaultInfo{{ID: "v1", Name: "Work"}, {ID: "v2", Name: "Personal"}}})
+	}))
+	defer srv.Close()
+	cfg := Config{BaseURL: srv.URL, APIKey: "k"}
+
+	details := []passwordDetail{
+		{ID: "a", VaultID: "v1", Path: []pathSegment{{Order: 0, Name: "Infra", Type: "folder"}}},
+		{ID: "b", VaultID: "v2"},
+		{ID: "c", VaultID: "v1", Path: []pathSegment{{Order: 0, Name: "Old name", Type: "vault"}}},
+		{ID: "d", VaultID: "v9", Path: []pathSegment{{Order: 0, Name: "Infra", Type: "folder"}}},
+	}
+	nameVaults(context.Background(), cfg, srv.Client(), "tok", details)
+	nameVaults(context.Background(), cfg, srv.Client(), "tok", details)
+	if calls != 1 {
+		t.Errorf("listed vaults %d times, want once per run", calls)
+	}
+	var got []string
+	for _, d := range details {
+		got = append(got, vaultName(d))
+	}
+	if want := []string{"Work", "Personal", "Work", "v9"}; !slices.Equal(got, want) {
+		t.Errorf("vault names = %v, want %v", got, want)
+	}
+
+	o := &filterOptions{groupByVault: true}
+	var order []string
+	for _, d := range filterDetails(details, o) {
+		order = append(order, d.ID)
+	}
+	if want := []string{"b", "a", "c", "d"}; !slices.Equal(order, want) {
+		t.Errorf("grouped order = %v, want %v", order, want)
+	}
+}
+
+func TestReadImportCSV(t *testing.T) {
+	const export = "\ufeffTitle,Notes,Username,Password,Web Site\n" +
+		"prod db,\"line one\nline two\",app,s3cret,https://db\n" +
+		",,nobody,pw,\n" +
+		"no password,,x,,\n" +
+		"\n" +
+		"ci token,,,tok,\n"
+	rows, problems, err := readImportCSV(strings.NewReader(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []importRow{
+		{line: 2, in: passwordInput{Name: "prod db", Login: "app", URL: "https://db", Description: "line one\nline two", CryptedPassword: "s3cret"}},
+		{line: 7, in: passwordInput{Name: "ci token", CryptedPassword: "tok"}},
+	}
+	if !slices.Equal(rows, want) {
+		t.Errorf("rows = %+v, want %+v", rows, want)
+	}
+	if wantProblems := []string{"line 4: no name", "line 5 (no password): no password"}; !slices.Equal(problems, wantProblems) {
+		t.Errorf("problems = %q, want %q", problems, wantProblems)
+	}
+
+	// Without a header row the columns are name,login,url,password,notes.
+	rows, problems, err = readImportCSV(strings.NewReader("web,me,https://w,pw,note\n"))
+	if err != nil || len(problems) > 0 {
+		t.Fatal(err, problems)
+	}
+	if got := rows[0].in; got.Name != "web" || got.CryptedPassword != "pw" || got.Description != "note" {
+		t.Errorf("headerless row = %+v", got)
+	}
+}
+
+func TestEntryJSONExclude(t *testing.T) {
+	p := passwordDetail{ID: "aa11", Name: "prod db", Login: "app",
+		CryptedPassword: base64.StdEncoding.EncodeToString([]byte("s3cret")),
+		Custom:          []customField{{Name: "otp", Value: "JBSWY3DP", Type: "totp"}}}
+	exclude, err := parseJSONExclude("password, custom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := entryJSON(p, exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]any
+	if err := json.Unmarshal(out, &m); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"password", "custom", "cryptedPassword"} {
+		if _, ok := m[key]; ok {
+			t.Errorf("%s is in the output: %s", key, out)
+		}
+	}
+	if m["name"] != "prod db" || m["login"] != "app" {
+		t.Errorf("metadata missing: %s", out)
+	}
+	if strings.Contains(string(out), "s3cret") || strings.Contains(string(out), "JBSWY3DP") {
+		t.Errorf("secret in the output: %s", out)
+	}
+
+	if _, err := parseJSONExclude("pasword"); err == nil {
+		t.Error("a misspelled field was accepted")
+	}
+	if _, err := parseJSONExclude("cryptedPassword"); err == nil {
+		t.Error("cryptedPassword was accepted, but -json never prints it")
+	}
+}
+
+// The API key is refused in an argument file as well as on the command line.
+func TestArgvSecretsInArgFile(t *testing.T) {
+	defer func(orig func() (fileConfig, error)) { loadConfigFile = orig }(loadConfigFile)
+	loadConfigFile = func() (fileConfig, error) { return fileConfig{}, nil }
+	t.Setenv("PASSWORK_API_KEY", "k3y-0123456789")
+	file := filepath.Join(t.TempDir(), "search.args")
+	if err := os.WriteFile(file, []byte("-first\nk3y-0123456789\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, argv := range [][]string{{"k3y-0123456789"}, {"@" + file}} {
+		err := runArgs(argv)
+		if err == nil || exitCodeFor(err) != exitConfig || !strings.Contains(err.Error(), "API key") {
+			t.Errorf("runArgs(%q) = %v, want the API key refused", argv, err)
+		}
+	}
+}
+
+// Dropped connections are retried; certificate and pin failures are not.
+func TestDoWithRetryClassifiesErrors(t *testing.T) {
+	t.Setenv("PWFZ_RETRIES", "3")
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _, _ := w.(http.Hijacker).Hijack()
+		c.Close() // no reply at all: the client sees EOF
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // the rejected handshakes
+	srv.StartTLS()
+	defer srv.Close()
+
+	pinned := srv.Client().Transport.(*http.Transport).Clone()
+	pinned.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		return verifyPin(cs, [][]byte{make([]byte, 32)})
+	}
+	tests := []struct {
+		name   string
+		client *http.Client
+		want   int32
+	}{
+		{"untrusted certificate", &http.Client{}, 1},
+		{"pin mismatch", &http.Client{Transport: pinned}, 1},
+		{"connection closed", srv.Client(), 3},
+	}
+	for _, tt := range tests {
+		conns.Store(0)
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		if _, err := doWithRetry(context.Background(), tt.client, req); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+		if got := conns.Load(); got != tt.want {
+			t.Errorf("%s: %d connections, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// PWFZ_RETRY_BUDGET is shared by every call: once spent, errors are final.
+func TestRetryBudgetShared(t *testing.T) {
+	t.Setenv("PWFZ_RETRIES", "3")
+	defer func(orig func() *retryBudget) { retries = orig }(retries)
+	budget := &retryBudget{limit: 1}
+	retries = func() *retryBudget { return budget }
+
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	for range 2 {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		resp, err := doWithRetry(context.Background(), srv.Client(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// The first call retries once and spends the budget; the second
+	// gives up after its first attempt.
+	if got := requests.Load(); got != 3 {
+		t.Errorf("%d requests, want 3", got)
+	}
+}
+
+// Custom fields the user did not touch go back exactly as stored, whatever
+// base64 variant another client used for them.
+func TestEditPatchKeepsUntouchedCustomFields(t *testing.T) {
+	std := base64.StdEncoding.EncodeToString
+	p := passwordDetail{Name: "prod db", Custom: []customField{
+		{Name: std([]byte("note")), Value: std([]byte("old")), Type: "text"},
+		{Name: base64.RawURLEncoding.EncodeToString([]byte("key")), Value: base64.URLEncoding.EncodeToString([]byte("a>>?b")), Type: "text"},
+		{Name: "region", Value: "us-east-1", Type: "text"},
+	}}
+	old, err := newEditDoc(p, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := old
+	edited.Custom = slices.Clone(old.Custom)
+	edited.Custom[0].Value = "new"
+	patch, _, err := editPatch(p, old, edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []customField{{Name: p.Custom[0].Name, Value: std([]byte("new")), Type: "text"}, p.Custom[1], p.Custom[2]}
+	if got := patch["custom"].([]customField); !slices.Equal(got, want) {
+		t.Errorf("custom = %+v, want %+v", got, want)
+	}
+}
+
+// Renaming a hidden field keeps its value, and deleting a field in front of
+// it does not hand it another field's value.
+func TestEditPatchRenameHiddenField(t *testing.T) {
+	std := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	p := passwordDetail{Name: "prod db", Custom: []customField{
+		{Name: std("backup"), Value: std("hunter2"), Type: "password"},
+		{Name: std("otp"), Value: std("JBSWY3DP"), Type: "totp"},
+	}}
+	old, err := newEditDoc(p, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edited := old
+	edited.Custom = slices.Clone(old.Custom)
+	edited.Custom[1].Name = "totp code"
+	patch, _, err := editPatch(p, old, edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []customField{p.Custom[0], {Name: std("totp code"), Value: p.Custom[1].Value, Type: "totp"}}
+	if got := patch["custom"].([]customField); !slices.Equal(got, want) {
+		t.Errorf("rename: custom = %+v, want %+v", got, want)
+	}
+
+	edited.Custom = []customField{old.Custom[1]}
+	patch, _, err = editPatch(p, old, edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := patch["custom"].([]customField); !slices.Equal(got, p.Custom[1:]) {
+		t.Errorf("delete: custom = %+v, want %+v", got, p.Custom[1:])
+	}
+}